@@ -0,0 +1,125 @@
+/*******************************************************************************
+* acl.go: per-user host access control
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+
+    "golang.org/x/crypto/ssh"
+)
+
+// allow list entry which grants access to every host
+const aclAllHosts = "*"
+
+// ssh.Permissions extension key holding the comma-separated list of hosts
+// that the authenticated user is allowed to wake
+const permAllowHosts = "allow-hosts"
+
+// ssh.Permissions extension key which is set to "yes" if the authenticated
+// user is allowed to wake arbitrary MAC addresses
+const permAllowMAC = "allow-mac"
+
+// ssh.Permissions extension key which is set to "yes" for admin users, who
+// can run admin-only commands
+const permAdmin = "admin"
+
+// ssh.Permissions extension key holding a command that's run instead of
+// whatever the client asks for, from an authorized key's command= option or
+// a certificate's force-command
+const permForceCommand = "force-command"
+
+// ssh.Permissions extension key which is set to "yes" if the key may not
+// request a pty, from authorized key options or certificates
+const permNoPty = "no-pty"
+
+// Expand a user's allow list (host aliases, group names, or "*") into a
+// sorted list of host aliases. An empty allow list grants access to all
+// hosts, for compatibility with configs written before ACLs existed.
+func (c *Config) ExpandAllow(allow []string) ([]string, error) {
+    if len(allow) == 0 {
+        return []string{aclAllHosts}, nil
+    }
+
+    hosts := map[string]bool{}
+    for _, a := range allow {
+        if a == aclAllHosts {
+            return []string{aclAllHosts}, nil
+        } else if members, ok := c.Groups[a]; ok {
+            for _, h := range members {
+                hosts[h] = true
+            }
+        } else if _, ok := c.Hosts[a]; ok {
+            hosts[a] = true
+        } else {
+            return nil, fmt.Errorf("unknown host or group '%s' in allow list", a)
+        }
+    }
+
+    list := make([]string, 0, len(hosts))
+    for h := range hosts {
+        list = append(list, h)
+    }
+    sort.Strings(list)
+    return list, nil
+}
+
+// Build the ssh.Permissions extensions for a user, given their expanded
+// allow list.
+func UserPermissions(u *UserConfig, allow []string) map[string]string {
+    perms := map[string]string{
+        permAllowHosts: strings.Join(allow, ","),
+    }
+    if u.AllowMAC {
+        perms[permAllowMAC] = "yes"
+    }
+    if u.Admin {
+        perms[permAdmin] = "yes"
+    }
+    return perms
+}
+
+// Check whether the permissions granted at authentication time allow
+// waking the given host alias.
+func PermsAllowHost(perms *ssh.Permissions, host string) bool {
+    if perms == nil {
+        return false
+    }
+    for _, h := range strings.Split(perms.Extensions[permAllowHosts], ",") {
+        if h == aclAllHosts || h == host {
+            return true
+        }
+    }
+    return false
+}
+
+// Check whether the permissions granted at authentication time allow waking
+// raw MAC addresses rather than only configured hosts.
+func PermsAllowMAC(perms *ssh.Permissions) bool {
+    return perms != nil && perms.Extensions[permAllowMAC] == "yes"
+}
+
+// Check whether the permissions granted at authentication time allow running
+// admin-only commands.
+func PermsAdmin(perms *ssh.Permissions) bool {
+    return perms != nil && perms.Extensions[permAdmin] == "yes"
+}
+
+// The command that the authenticated key is restricted to, if any
+func PermsForceCommand(perms *ssh.Permissions) string {
+    if perms == nil {
+        return ""
+    }
+    return perms.Extensions[permForceCommand]
+}
+
+// Check whether the authenticated key may request a pty
+func PermsAllowPty(perms *ssh.Permissions) bool {
+    return perms == nil || perms.Extensions[permNoPty] != "yes"
+}
@@ -0,0 +1,333 @@
+/*******************************************************************************
+* auth.go: SSH certificate authentication and key revocation
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "net"
+    "os"
+    "path"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+)
+
+// Trusted certificate authorities and revoked keys. Keys are stored in
+// their marshaled wire format.
+type certAuth struct {
+    globalCAs   map[string]bool             // trusted for all users
+    userCAs     map[string]map[string]bool  // trusted for one user
+    principals  map[string][]string         // accepted cert principals per user
+    revokedKeys map[string]bool
+    checker     ssh.CertChecker
+}
+
+func newCertAuth(c *Config) (*certAuth, error) {
+    ca := &certAuth{
+        userCAs:    map[string]map[string]bool{},
+        principals: map[string][]string{},
+    }
+
+    var err error
+    if ca.globalCAs, err = parseKeySet(c.TrustedCAs); err != nil {
+        return nil, fmt.Errorf("bad trusted_ca: %v", err)
+    }
+    for _, u := range c.Users {
+        if ca.userCAs[u.Name], err = parseKeySet(u.TrustedCAs); err != nil {
+            return nil, fmt.Errorf("bad trusted_ca for user %q: %v", u.Name, err)
+        }
+        // like OpenSSH, the user name is the principal unless a list is given
+        ca.principals[u.Name] = u.Principals
+        if len(u.Principals) == 0 {
+            ca.principals[u.Name] = []string{u.Name}
+        }
+    }
+
+    ca.revokedKeys = map[string]bool{}
+    if c.RevokedKeys != "" {
+        data, err := ioutil.ReadFile(c.RevokedKeys)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read revoked_keys: %v", err)
+        }
+        if ca.revokedKeys, err = parseKeySet([]string{string(data)}); err != nil {
+            return nil, fmt.Errorf("bad revoked_keys file %s: %v", c.RevokedKeys, err)
+        }
+        log.Info("Loaded %d revoked keys", len(ca.revokedKeys))
+    }
+
+    if n := len(ca.globalCAs); n > 0 {
+        log.Info("Loaded %d trusted certificate authorities", n)
+    }
+
+    // CertChecker handles validity times, signatures, and unknown critical
+    // options. source-address is checked by the ssh package after auth,
+    // using the CriticalOptions we return.
+    ca.checker = ssh.CertChecker{
+        SupportedCriticalOptions: []string{"force-command"},
+        IsRevoked: func(cert *ssh.Certificate) bool {
+            return ca.revoked(cert.Key) || ca.revoked(cert.SignatureKey)
+        },
+    }
+    return ca, nil
+}
+
+// Parse authorized_keys format lines into a set of marshaled keys, skipping
+// blank lines and comments
+func parseKeySet(keys []string) (map[string]bool, error) {
+    set := map[string]bool{}
+    for _, key := range keys {
+        for _, line := range strings.Split(key, "\n") {
+            line = strings.TrimSpace(line)
+            if line == "" || strings.HasPrefix(line, "#") {
+                continue
+            }
+            pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+            if err != nil {
+                return nil, err
+            }
+            set[string(pubKey.Marshal())] = true
+        }
+    }
+    return set, nil
+}
+
+// whether a user can log in with any certificate
+func (ca *certAuth) trusts(user string) bool {
+    return len(ca.globalCAs) > 0 || len(ca.userCAs[user]) > 0
+}
+
+func (ca *certAuth) revoked(key ssh.PublicKey) bool {
+    return ca.revokedKeys[string(key.Marshal())]
+}
+
+// Check a user certificate. It must be signed by a CA trusted globally or for
+// this user, and list one of the user's accepted principals.
+func (ca *certAuth) authenticate(user string, cert *ssh.Certificate) (*ssh.Permissions, error) {
+    if cert.CertType != ssh.UserCert {
+        return nil, fmt.Errorf("certificate for %q is not a user certificate", user)
+    }
+    signer := string(cert.SignatureKey.Marshal())
+    if !ca.globalCAs[signer] && !ca.userCAs[user][signer] {
+        return nil, fmt.Errorf("certificate for %q signed by unrecognized authority %s",
+                               user, ssh.FingerprintSHA256(cert.SignatureKey))
+    }
+    // an empty principal list would match anyone
+    if len(cert.ValidPrincipals) == 0 {
+        return nil, fmt.Errorf("certificate %q for %q has no principals", cert.KeyId, user)
+    }
+
+    var err error
+    for _, p := range ca.principals[user] {
+        if err = ca.checker.CheckCert(p, cert); err == nil {
+            break
+        }
+    }
+    if err != nil {
+        return nil, fmt.Errorf("certificate %q rejected for %q: %v", cert.KeyId, user, err)
+    }
+
+    perms := &ssh.Permissions{
+        CriticalOptions: cert.CriticalOptions,
+        Extensions: map[string]string{
+            "pubkey-fp": ssh.FingerprintSHA256(cert.Key),
+            "pubkey-comment": fmt.Sprintf("cert %q serial %d", cert.KeyId, cert.Serial),
+        },
+    }
+    if cmd, ok := cert.CriticalOptions["force-command"]; ok {
+        perms.Extensions[permForceCommand] = cmd
+    }
+    if _, ok := cert.Extensions["permit-pty"]; !ok {
+        perms.Extensions[permNoPty] = "yes"
+    }
+    return perms, nil
+}
+
+// An authorized public key and the OpenSSH options it was listed with
+type authorizedKey struct {
+    comment     string
+    from        []string    // patterns from from="..."
+    expiry      time.Time   // from expiry-time, zero if none
+    command     string      // from command="..."
+    noPty       bool        // from no-pty or restrict
+}
+
+// Parse authorized_keys lines. Bad lines are an error if strict, otherwise
+// they're logged and skipped like OpenSSH does.
+func parseAuthorizedKeys(source, data string, strict bool) (map[string]*authorizedKey, error) {
+    keys := map[string]*authorizedKey{}
+    for i, line := range strings.Split(data, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        pubKey, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+        if err == nil {
+            k := &authorizedKey{comment: comment}
+            if err = k.parseOptions(options); err == nil {
+                keys[string(pubKey.Marshal())] = k
+                continue
+            }
+        }
+        if strict {
+            return nil, fmt.Errorf("%s: %v", source, err)
+        }
+        log.Warning("%s line %d: %v", source, i+1, err)
+    }
+    return keys, nil
+}
+
+func (k *authorizedKey) parseOptions(options []string) error {
+    for _, opt := range options {
+        name, value := opt, ""
+        if i := strings.Index(opt, "="); i >= 0 {
+            name = opt[:i]
+            value = strings.Replace(strings.Trim(opt[i+1:], "\""), "\\\"", "\"", -1)
+        }
+        switch strings.ToLower(name) {
+            case "from":
+                k.from = strings.Split(value, ",")
+            case "expiry-time":
+                t, err := parseExpiryTime(value)
+                if err != nil {
+                    return err
+                }
+                k.expiry = t
+            case "command":
+                k.command = value
+            case "restrict", "no-pty":
+                k.noPty = true
+            case "pty":
+                k.noPty = false
+            case "no-port-forwarding", "no-agent-forwarding", "no-x11-forwarding", "no-user-rc",
+                 "port-forwarding", "agent-forwarding", "x11-forwarding", "user-rc":
+                // wolssh doesn't support any of these anyway
+            default:
+                return fmt.Errorf("unsupported key option '%s'", name)
+        }
+    }
+    return nil
+}
+
+// Parse an expiry-time value, YYYYMMDD[HHMM[SS]] in local time or UTC if
+// followed by Z
+func parseExpiryTime(s string) (time.Time, error) {
+    loc := time.Local
+    if strings.HasSuffix(s, "Z") || strings.HasSuffix(s, "z") {
+        loc = time.UTC
+        s = s[:len(s)-1]
+    }
+    for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+        if len(s) == len(layout) {
+            if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+                return t, nil
+            }
+        }
+    }
+    return time.Time{}, fmt.Errorf("invalid expiry-time '%s'", s)
+}
+
+// Check a key's restrictions for a connection
+func (k *authorizedKey) check(remote net.Addr) error {
+    if !k.expiry.IsZero() && time.Now().After(k.expiry) {
+        return fmt.Errorf("key expired at %s", k.expiry.Format("2006-01-02 15:04:05"))
+    }
+    if len(k.from) > 0 && !matchFrom(k.from, remote) {
+        return fmt.Errorf("key not allowed from this address")
+    }
+    return nil
+}
+
+// Set permissions extensions for a key's options
+func (k *authorizedKey) apply(perms *ssh.Permissions) {
+    if k.command != "" {
+        perms.Extensions[permForceCommand] = k.command
+    }
+    if k.noPty {
+        perms.Extensions[permNoPty] = "yes"
+    }
+}
+
+// Match an address against from= patterns, which are wildcards (* and ?) or
+// CIDR blocks, optionally negated with !. A negated match always denies.
+func matchFrom(patterns []string, remote net.Addr) bool {
+    host, _, err := net.SplitHostPort(remote.String())
+    if err != nil {
+        host = remote.String()
+    }
+    ip := net.ParseIP(host)
+
+    matched := false
+    for _, p := range patterns {
+        negate := strings.HasPrefix(p, "!")
+        p = strings.TrimPrefix(p, "!")
+        var m bool
+        if strings.Contains(p, "/") {
+            _, ipnet, err := net.ParseCIDR(p)
+            m = err == nil && ip != nil && ipnet.Contains(ip)
+        } else {
+            m, _ = path.Match(p, host)
+        }
+        if m && negate {
+            return false
+        }
+        matched = matched || m
+    }
+    return matched
+}
+
+// An authorized_keys file, re-read whenever it changes
+type keyFile struct {
+    path    string
+    modTime time.Time
+    size    int64
+    keys    map[string]*authorizedKey
+    lastErr string
+    mtx     sync.Mutex
+}
+
+// Expand %u in an authorized_keys_file path to the user name
+func expandKeyFilePath(p, user string) string {
+    return strings.NewReplacer("%u", user, "%%", "%").Replace(p)
+}
+
+// Current keys in the file, re-reading it if it changed. A missing or
+// unreadable file has no keys.
+func (f *keyFile) Keys() map[string]*authorizedKey {
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+
+    fi, err := os.Stat(f.path)
+    if err == nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+        return f.keys
+    }
+    var data []byte
+    if err == nil {
+        data, err = ioutil.ReadFile(f.path)
+    }
+    if err != nil {
+        // only log each problem once
+        if err.Error() != f.lastErr {
+            f.lastErr = err.Error()
+            if os.IsNotExist(err) {
+                log.Debug("No authorized keys file: %v", err)
+            } else {
+                log.Warning("Failed to read authorized keys: %v", err)
+            }
+        }
+        f.keys, f.modTime, f.size = nil, time.Time{}, 0
+        return nil
+    }
+
+    f.keys, _ = parseAuthorizedKeys(f.path, string(data), false)
+    f.modTime, f.size, f.lastErr = fi.ModTime(), fi.Size(), ""
+    log.Info("Loaded %d authorized keys from %s", len(f.keys), f.path)
+    return f.keys
+}
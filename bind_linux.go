@@ -0,0 +1,23 @@
+/*******************************************************************************
+* bind_linux.go: bind sockets to a network interface
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "fmt"
+    "syscall"
+)
+
+func bindToDevice(fd uintptr, iface string) error {
+    err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+    if err == syscall.EPERM {
+        return fmt.Errorf("binding to interface %s requires CAP_NET_RAW", iface)
+    } else if err != nil {
+        return fmt.Errorf("failed to bind to interface %s: %v", iface, err)
+    }
+    return nil
+}
@@ -0,0 +1,18 @@
+// +build !linux
+
+/*******************************************************************************
+* bind_other.go: stub for binding sockets to a network interface
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "fmt"
+)
+
+func bindToDevice(fd uintptr, iface string) error {
+    return fmt.Errorf("binding to interface %s is only supported on Linux", iface)
+}
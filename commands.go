@@ -0,0 +1,423 @@
+/*******************************************************************************
+* commands.go: command parsing and handlers for exec requests
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "text/tabwriter"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+)
+
+// exit statuses returned to the SSH client
+const (
+    EXIT_OK byte = iota
+    EXIT_UNKNOWN_HOST
+    EXIT_SEND_FAILED
+    EXIT_DENIED
+    EXIT_USAGE
+    EXIT_TIMEOUT
+    EXIT_UNAVAILABLE
+    EXIT_RATE_LIMITED
+)
+
+// Session is the state passed to each command handler
+type Session struct {
+    User    string
+    Perms   *ssh.Permissions
+    Out     io.Writer
+    Err     io.Writer
+}
+
+type Command struct {
+    Name    string
+    Args    string
+    Help    string
+    MinArgs int
+    MaxArgs int     // -1 for unlimited
+    Run     func(s *Session, args []string) byte
+    Admin   bool    // only available to admin users
+}
+
+// list of commands, in the order shown by help. Populated in init() to avoid
+// an initialization loop with cmdHelp.
+var commands []*Command
+
+func init() {
+    commands = []*Command{
+        {"wake", "[--wait[=SECONDS]] <host|group|MAC>...", "Send a wake-on-LAN packet to one or more hosts, optionally waiting for them to come up. Raw MAC addresses require permission.", 1, -1, cmdWake, false},
+        {"list", "", "List hosts and groups that you may wake and whether they're up", 0, 0, cmdList, false},
+        {"status", "<host>", "Show information about a host and whether it's up", 1, 1, cmdStatus, false},
+        {"help", "[command]", "Show this help, or help for a single command", 0, 1, cmdHelp, false},
+        {"version", "", "Show the wolssh version", 0, 0, cmdVersion, false},
+        {"discover", "[--ini] [--all]", "Find hosts in the ARP/neighbor tables and DHCP leases. --ini prints [hosts] entries, --all includes hosts that are already configured.", 0, 2, cmdDiscover, true},
+    }
+}
+
+func FindCommand(name string) *Command {
+    for _, c := range commands {
+        if c.Name == name {
+            return c
+        }
+    }
+    return nil
+}
+
+func (c *Command) Usage() string {
+    if c.Args == "" {
+        return c.Name
+    }
+    return c.Name + " " + c.Args
+}
+
+// Parse and run a command line, returning the exit status.
+// For backwards compatibility, a single word which isn't a command name is
+// treated as "wake <word>".
+func (s *Session) RunCommand(line string) byte {
+    args := strings.Fields(line)
+    if len(args) == 0 {
+        fmt.Fprintln(s.Err, "No command given, try 'help'")
+        return EXIT_USAGE
+    }
+
+    cmd := FindCommand(args[0])
+    if cmd == nil {
+        if len(args) == 1 {
+            return cmdWake(s, args)
+        }
+        fmt.Fprintf(s.Err, "Unknown command '%s', try 'help'\n", args[0])
+        return EXIT_USAGE
+    }
+
+    if cmd.Admin && !PermsAdmin(s.Perms) {
+        log.Warning("user %s denied admin command '%s'", s.User, cmd.Name)
+        fmt.Fprintf(s.Err, "Permission denied for command '%s'\n", cmd.Name)
+        return EXIT_DENIED
+    }
+
+    args = args[1:]
+    if len(args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(args) > cmd.MaxArgs) {
+        fmt.Fprintf(s.Err, "Usage: %s\n", cmd.Usage())
+        return EXIT_USAGE
+    }
+    return cmd.Run(s, args)
+}
+
+func cmdWake(s *Session, args []string) byte {
+    // wait < 0 means use each host's default wait time
+    var wait time.Duration
+    var hosts []string
+    for _, a := range args {
+        switch {
+            case a == "--wait" || a == "-w":
+                wait = -1
+            case strings.HasPrefix(a, "--wait="):
+                secs, err := strconv.Atoi(strings.TrimPrefix(a, "--wait="))
+                if err != nil || secs <= 0 {
+                    fmt.Fprintf(s.Err, "Invalid wait time '%s'\n", a)
+                    return EXIT_USAGE
+                }
+                wait = time.Duration(secs) * time.Second
+            case strings.HasPrefix(a, "-"):
+                fmt.Fprintf(s.Err, "Unknown option '%s'\n", a)
+                return EXIT_USAGE
+            default:
+                hosts = append(hosts, a)
+        }
+    }
+    if len(hosts) == 0 {
+        fmt.Fprintf(s.Err, "Usage: %s\n", FindCommand("wake").Usage())
+        return EXIT_USAGE
+    }
+
+    hosts = expandGroups(hosts, s.Perms)
+
+    // Resolve and check permissions first, so that only commands which
+    // send something count against the rate limit. Configured hosts count
+    // once per command, so that groups can always be woken, but each raw MAC
+    // address counts separately so a long list of them can't flood the
+    // network.
+    results := make([]wakeResult, len(hosts))
+    cost := 0
+    anyConfigured := false
+    for i, host := range hosts {
+        r := &results[i]
+        r.name = host
+        if r.host, r.msg, r.status = ResolveWakeHost(host, s.Perms); r.host == nil {
+            continue
+        }
+        if _, ok := Conf().Hosts[r.host.Name]; ok {
+            anyConfigured = true
+        } else {
+            cost++
+        }
+    }
+    if anyConfigured {
+        cost++
+    }
+    if cost > 0 && !allowWakes(s.User, cost) {
+        log.Warning("user %s wake rate limit exceeded", s.User)
+        fmt.Fprintf(s.Err, "Too many wake requests, limit is %d per minute\n", Conf().WakeRateLimit)
+        return EXIT_RATE_LIMITED
+    }
+
+    // wake everything in parallel, then report in the order given
+    var wg sync.WaitGroup
+    for i := range results {
+        if results[i].host == nil {
+            continue
+        }
+        wg.Add(1)
+        go func(r *wakeResult) {
+            defer wg.Done()
+            if r.msg, r.status = WakeHost(r.host); r.status != EXIT_OK {
+                r.host = nil
+            }
+        }(&results[i])
+    }
+    wg.Wait()
+
+    // the exit status is that of the first failure
+    status := EXIT_OK
+    setStatus := func(st byte) {
+        if status == EXIT_OK {
+            status = st
+        }
+    }
+
+    if len(results) == 1 {
+        // keep the plain message for a single host, scripts may rely on it
+        if results[0].status == EXIT_OK {
+            fmt.Fprintln(s.Out, results[0].msg)
+        } else {
+            fmt.Fprintln(s.Err, results[0].msg)
+        }
+    } else {
+        tw := tabwriter.NewWriter(s.Out, 0, 8, 2, ' ', 0)
+        fmt.Fprintln(tw, "HOST\tMAC\tRESULT")
+        for _, r := range results {
+            if r.status == EXIT_OK {
+                fmt.Fprintf(tw, "%s\t%s\tok\n", r.name, r.host.MAC)
+            } else {
+                fmt.Fprintf(tw, "%s\t-\t%s\n", r.name, r.msg)
+            }
+        }
+        tw.Flush()
+    }
+
+    var woken []*HostConfig
+    for _, r := range results {
+        if r.status == EXIT_OK {
+            woken = append(woken, r.host)
+        } else {
+            setStatus(r.status)
+        }
+    }
+
+    if wait != 0 {
+        start := time.Now()
+        out := &lockedWriter{w: s.Out}
+        waitStatus := make([]byte, len(woken))
+        for i, h := range woken {
+            deadline := start.Add(wait)
+            if wait < 0 {
+                deadline = start.Add(h.WaitTime())
+            }
+            if err := h.CanWait(); err != nil {
+                fmt.Fprintf(s.Err, "Can't wait for host %s, %v\n", h.Name, err)
+                waitStatus[i] = EXIT_USAGE
+                continue
+            }
+            wg.Add(1)
+            go func(i int, h *HostConfig) {
+                defer wg.Done()
+                if !WaitForHost(h, deadline, out) {
+                    waitStatus[i] = EXIT_TIMEOUT
+                }
+            }(i, h)
+        }
+        wg.Wait()
+        for _, st := range waitStatus {
+            if st != EXIT_OK {
+                setStatus(st)
+            }
+        }
+    }
+    return status
+}
+
+type wakeResult struct {
+    name    string      // as given by the user
+    host    *HostConfig // nil on failure
+    msg     string
+    status  byte
+}
+
+// Replace group names with the member hosts that the user may wake,
+// removing duplicates. This matches what "list" shows for each group. A group
+// with no such members is left alone, so waking it reports an error like any
+// other name the user can't wake. Anything that's not a group is left alone.
+func expandGroups(names []string, perms *ssh.Permissions) []string {
+    var hosts []string
+    seen := map[string]bool{}
+    for _, name := range names {
+        var members []string
+        for _, h := range Conf().Groups[name] {
+            if PermsAllowHost(perms, h) {
+                members = append(members, h)
+            }
+        }
+        if len(members) == 0 {
+            members = []string{name}
+        }
+        for _, h := range members {
+            if !seen[h] {
+                seen[h] = true
+                hosts = append(hosts, h)
+            }
+        }
+    }
+    return hosts
+}
+
+// writer that's safe to use from multiple goroutines
+type lockedWriter struct {
+    w       io.Writer
+    mtx     sync.Mutex
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+    lw.mtx.Lock()
+    defer lw.mtx.Unlock()
+    return lw.w.Write(p)
+}
+
+func cmdList(s *Session, args []string) byte {
+    c := Conf()
+    names := make([]string, 0, len(c.Hosts))
+    for name := range c.Hosts {
+        if PermsAllowHost(s.Perms, name) {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+
+    if len(names) == 0 {
+        fmt.Fprintln(s.Out, "No hosts available")
+        return EXIT_OK
+    }
+    hosts := make([]*HostConfig, len(names))
+    for i, name := range names {
+        hosts[i] = c.Hosts[name]
+    }
+    status := CheckHosts(hosts)
+
+    tw := tabwriter.NewWriter(s.Out, 0, 8, 2, ' ', 0)
+    for _, h := range hosts {
+        fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", h.Name, h.MAC, status[h.Name].State, h.Description)
+    }
+    tw.Flush()
+
+    if groups := allowedGroups(s.Perms); len(groups) > 0 {
+        fmt.Fprintln(s.Out, "\nGroups:")
+        tw = tabwriter.NewWriter(s.Out, 0, 8, 2, ' ', 0)
+        for _, g := range groups {
+            // don't show other users' hosts
+            var members []string
+            for _, h := range c.Groups[g] {
+                if PermsAllowHost(s.Perms, h) {
+                    members = append(members, h)
+                }
+            }
+            fmt.Fprintf(tw, "%s\t%s\n", g, strings.Join(members, ", "))
+        }
+        tw.Flush()
+    }
+    return EXIT_OK
+}
+
+// sorted names of groups containing at least one host the user may wake
+func allowedGroups(perms *ssh.Permissions) []string {
+    var groups []string
+    for g, members := range Conf().Groups {
+        for _, h := range members {
+            if PermsAllowHost(perms, h) {
+                groups = append(groups, g)
+                break
+            }
+        }
+    }
+    sort.Strings(groups)
+    return groups
+}
+
+func cmdStatus(s *Session, args []string) byte {
+    host := args[0]
+    // check permission first so users can't find out other users' host names
+    if !PermsAllowHost(s.Perms, host) {
+        fmt.Fprintf(s.Err, "Permission denied for host '%s'\n", host)
+        return EXIT_DENIED
+    }
+    h, err := ResolveHost(host)
+    if err != nil {
+        fmt.Fprintln(s.Err, err)
+        return EXIT_UNKNOWN_HOST
+    }
+
+    fmt.Fprintf(s.Out, "Host:      %s\n", host)
+    if h.Description != "" {
+        fmt.Fprintf(s.Out, "Desc:      %s\n", h.Description)
+    }
+    fmt.Fprintf(s.Out, "MAC:       %s\n", h.MAC)
+    if h.Address != "" {
+        fmt.Fprintf(s.Out, "Address:   %s\n", h.ProbeAddr())
+    } else if h.ProbeHost() != "" {
+        fmt.Fprintf(s.Out, "Address:   %s (learned)\n", h.ProbeAddr())
+    }
+    for _, b := range h.BroadcastAddrs() {
+        fmt.Fprintf(s.Out, "Broadcast: %s\n", b.Marshal())
+    }
+    if h.Interface != "" {
+        fmt.Fprintf(s.Out, "Interface: %s\n", h.Interface)
+    }
+    fmt.Fprintf(s.Out, "Status:    %s\n", CheckHosts([]*HostConfig{h})[h.Name])
+    return EXIT_OK
+}
+
+func cmdHelp(s *Session, args []string) byte {
+    if len(args) == 1 {
+        cmd := FindCommand(args[0])
+        if cmd == nil {
+            fmt.Fprintf(s.Err, "Unknown command '%s'\n", args[0])
+            return EXIT_USAGE
+        }
+        fmt.Fprintf(s.Out, "Usage: %s\n  %s\n", cmd.Usage(), cmd.Help)
+        return EXIT_OK
+    }
+
+    fmt.Fprintln(s.Out, "Available commands:")
+    tw := tabwriter.NewWriter(s.Out, 0, 8, 2, ' ', 0)
+    for _, cmd := range commands {
+        if !cmd.Admin || PermsAdmin(s.Perms) {
+            fmt.Fprintf(tw, "  %s\t%s\n", cmd.Usage(), cmd.Help)
+        }
+    }
+    tw.Flush()
+    return EXIT_OK
+}
+
+func cmdVersion(s *Session, args []string) byte {
+    fmt.Fprintln(s.Out, "wolssh version", versionString())
+    return EXIT_OK
+}
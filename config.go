@@ -9,11 +9,15 @@ package main
 
 import (
     "fmt"
+    "net"
+    "strconv"
     "strings"
 
     "gopkg.in/ini.v1"
 )
 
+const defaultListenPort = 2222
+
 type LogConfig struct {
     Level       int
     Timestamp   bool
@@ -25,23 +29,81 @@ type LogConfig struct {
 }
 
 type UserConfig struct {
+    Name                string
+    Keys                []string    `ini:"pubkey,omitempty,allowshadow"`
+    Allow               []string    `ini:"allow,omitempty,allowshadow"`
+    AllowMAC            bool        `ini:"allow_mac"`
+    Admin               bool
+    TrustedCAs          []string    `ini:"trusted_ca,omitempty,allowshadow"`
+    Principals          []string    `ini:"principals,omitempty,allowshadow"`
+    AuthorizedKeysFile  string
+    PasswordHash        string      `ini:"password_hash"`
+    TOTPSecret          string      `ini:"totp_secret"`
+    AllowFrom           []string    `ini:"allow_from,omitempty,allowshadow"`
+    DenyFrom            []string    `ini:"deny_from,omitempty,allowshadow"`
+    sourceFilter        *AddrFilter `ini:"-"`
+}
+
+type GroupConfig struct {
     Name    string
-    Keys    []string `ini:"pubkey,omitempty,allowshadow"`
+    Hosts   []string `ini:"hosts,omitempty,allowshadow"`
+}
+
+type HostConfig struct {
+    Name            string          `ini:"-"`
+    MAC             string          `ini:"mac"`
+    Description     string
+    Address         string          // IP or hostname used to check if the host is up
+    Port            int             // TCP port used to check if the host is up
+    Probe           string          // how to check if the host is up, see probeMethods
+    WaitTimeout     int             // overrides the global wait_timeout if nonzero
+    BcastStrs       []string        `ini:"broadcast,omitempty,allowshadow"`
+    bcastAddrs      []BroadcastAddr `ini:"-"`
+    Interface       string          // network interface to send magic packets from
+    Source          string          // local IP address to send magic packets from
+    Password        string          // SecureOn password, see ParseSecureOnPassword
+    password        []byte          `ini:"-"`
+    Transport       string          // overrides the global transport if non-empty
+    EtherUnicast    bool            // send raw ethernet frames to the host's MAC rather than broadcast
+    WakePort        int             // UDP port for the unicast transport
+    WakeCommand     string          // overrides the global wake_command if non-empty
+    cfg             *Config         `ini:"-"`    // config this host belongs to, for defaults
 }
 
 type Config struct {
-    Listen      string
-    HostKeys    []string            `ini:",,allowshadow"`
-    Log         LogConfig
-    BcastStrs   []string            `ini:"broadcast,omitempty,allowshadow"`
-    bcastAddrs  []BroadcastAddr     `ini:"-"`
-    Hosts       map[string]string   `ini:"-"`
-    Users       []UserConfig        `ini:"-"`
+    Listen              []string                `ini:",,allowshadow"`
+    HostKeys            []string                `ini:",,allowshadow"`
+    Log                 LogConfig
+    BcastStrs           []string                `ini:"broadcast,omitempty,allowshadow"`
+    bcastAddrs          []BroadcastAddr         `ini:"-"`
+    WaitTimeout         int
+    ShutdownTimeout     int
+    HandshakeTimeout    int
+    MaxHandshakes       int
+    MaxAuthFailures     int
+    BanTime             int
+    WakeRateLimit       int
+    Transport           string
+    Interface           string
+    WakeCommand         string
+    LeaseFiles          []string                `ini:"lease_file,omitempty,allowshadow"`
+    StateFile           string
+    TrustedCAs          []string                `ini:"trusted_ca,omitempty,allowshadow"`
+    RevokedKeys         string
+    AuthorizedKeysFile  string
+    AllowFrom           []string                `ini:"allow_from,omitempty,allowshadow"`
+    DenyFrom            []string                `ini:"deny_from,omitempty,allowshadow"`
+    sourceFilter        *AddrFilter             `ini:"-"`
+    ProxyFrom           []string                `ini:"proxy_from,omitempty,allowshadow"`
+    proxyNets           []*net.IPNet            `ini:"-"`
+    Hosts               map[string]*HostConfig  `ini:"-"`
+    Groups              map[string][]string     `ini:"-"`
+    Users               []UserConfig            `ini:"-"`
 }
 
 func DefaultConfig() (*Config) {
     return &Config{
-        Listen:     ":2222",
+        Listen:     []string{":2222"},
         HostKeys:   []string{"ssh/ssh_host_*_key"},
         Log: LogConfig{
             Level:      int(LOG_LEVEL_INFO),
@@ -53,9 +115,22 @@ func DefaultConfig() (*Config) {
             Tag:        "wolssh",
         },
         BcastStrs:  []string{"255.255.255.255"},
+        WaitTimeout: 120,
+        ShutdownTimeout: 30,
+        HandshakeTimeout: 60,
+        MaxHandshakes: 20,
+        MaxAuthFailures: 5,
+        BanTime:    600,
+        WakeRateLimit: 10,
+        Transport:  TRANSPORT_UDP,
+        Hosts:      map[string]*HostConfig{},
+        Groups:     map[string][]string{},
     }
 }
 
+// Load a config file on top of the defaults. The returned config is fully
+// validated and nothing global is changed, so a failed reload leaves the
+// running config alone.
 func LoadConfig(filename string) (*Config, error) {
     // workaround to set options/mapper since we can't do both using
     // ShadowLoad/StrictMapToWithMapper
@@ -68,7 +143,11 @@ func LoadConfig(filename string) (*Config, error) {
     }
 
     // map everything that go-ini can
-    if err := iconf.Section("wolssh").StrictMapTo(conf); err != nil {
+    c := DefaultConfig()
+    if err := iconf.Section("wolssh").StrictMapTo(c); err != nil {
+        return nil, err
+    }
+    if err := c.ParseGlobal(); err != nil {
         return nil, err
     }
 
@@ -78,11 +157,275 @@ func LoadConfig(filename string) (*Config, error) {
         if err := s.StrictMapTo(&u); err != nil {
             return nil, fmt.Errorf("failed to map user %s: %v\n", u.Name, err)
         }
-        conf.Users = append(conf.Users, u)
+        if u.PasswordHash != "" {
+            if err := ValidatePasswordHash(u.PasswordHash); err != nil {
+                return nil, fmt.Errorf("user %s: %v", u.Name, err)
+            }
+        }
+        var err error
+        if u.sourceFilter, err = ParseAddrFilter(u.AllowFrom, u.DenyFrom); err != nil {
+            return nil, fmt.Errorf("user %s: %v", u.Name, err)
+        }
+        if u.TOTPSecret != "" {
+            if u.PasswordHash == "" {
+                return nil, fmt.Errorf("user %s: totp_secret requires a password_hash", u.Name)
+            }
+            if _, err := ParseTOTPSecret(u.TOTPSecret); err != nil {
+                return nil, fmt.Errorf("user %s: %v", u.Name, err)
+            }
+        }
+        c.Users = append(c.Users, u)
     }
 
-    // set up hosts mapping
-    conf.Hosts = iconf.Section("hosts").KeysHash()
+    // set up hosts mapping, from both the flat [hosts] section and
+    // [host.<name>] sections
+    for name, value := range iconf.Section("hosts").KeysHash() {
+        h, err := c.ParseHostLine(name, value)
+        if err != nil {
+            return nil, err
+        }
+        c.Hosts[name] = h
+    }
+    for _, s := range iconf.Section("host").ChildSections() {
+        h := c.NewHostConfig(strings.TrimPrefix(s.Name(), "host."))
+        if err := s.StrictMapTo(h); err != nil {
+            return nil, fmt.Errorf("failed to map host %s: %v", h.Name, err)
+        }
+        if _, ok := c.Hosts[h.Name]; ok {
+            return nil, fmt.Errorf("duplicate host %s", h.Name)
+        }
+        c.Hosts[h.Name] = h
+    }
+    for _, h := range c.Hosts {
+        if err := h.Validate(); err != nil {
+            return nil, err
+        }
+        // "ssh wol@router <host>" would run the command instead
+        if FindCommand(h.Name) != nil {
+            return nil, fmt.Errorf("host %s has the same name as a command", h.Name)
+        }
+    }
 
-    return conf, nil
+    // set up host groups, which can be used in place of host names in
+    // a user's allow list
+    for _, s := range iconf.Section("group").ChildSections() {
+        g := GroupConfig{Name: strings.TrimPrefix(s.Name(), "group.")}
+        if err := s.StrictMapTo(&g); err != nil {
+            return nil, fmt.Errorf("failed to map group %s: %v", g.Name, err)
+        }
+        if _, ok := c.Hosts[g.Name]; ok {
+            return nil, fmt.Errorf("group %s has the same name as a host", g.Name)
+        }
+        if FindCommand(g.Name) != nil {
+            return nil, fmt.Errorf("group %s has the same name as a command", g.Name)
+        }
+        for _, h := range g.Hosts {
+            if _, ok := c.Hosts[h]; !ok {
+                return nil, fmt.Errorf("group %s: unknown host %s", g.Name, h)
+            }
+        }
+        c.Groups[g.Name] = g.Hosts
+    }
+
+    // make sure users can only be granted things that exist
+    for _, u := range c.Users {
+        if _, err := c.ExpandAllow(u.Allow); err != nil {
+            return nil, fmt.Errorf("user %s: %v", u.Name, err)
+        }
+    }
+
+    return c, nil
+}
+
+// Validate and parse settings from the [wolssh] section
+func (c *Config) ParseGlobal() error {
+    for i, l := range c.Listen {
+        addr, err := ParseListenAddr(l)
+        if err != nil {
+            return err
+        }
+        c.Listen[i] = addr
+    }
+    if len(c.Listen) == 0 {
+        return fmt.Errorf("no listen addresses")
+    }
+    if c.ShutdownTimeout < 0 {
+        return fmt.Errorf("negative shutdown_timeout")
+    }
+    for name, v := range map[string]int{
+        "handshake_timeout": c.HandshakeTimeout,
+        "max_handshakes": c.MaxHandshakes,
+        "max_auth_failures": c.MaxAuthFailures,
+        "ban_time": c.BanTime,
+        "wake_rate_limit": c.WakeRateLimit,
+    } {
+        if v < 0 {
+            return fmt.Errorf("negative %s", name)
+        }
+    }
+    if !validTransport(c.Transport) {
+        return fmt.Errorf("unknown transport '%s'", c.Transport)
+    }
+
+    var err error
+    if c.sourceFilter, err = ParseAddrFilter(c.AllowFrom, c.DenyFrom); err != nil {
+        return err
+    }
+    if c.proxyNets, err = ParseNets(c.ProxyFrom); err != nil {
+        return fmt.Errorf("proxy_from: %v", err)
+    }
+
+    c.bcastAddrs = make([]BroadcastAddr, len(c.BcastStrs))
+    for i, bs := range c.BcastStrs {
+        b := MakeBroadcastAddr(bs)
+        if b == nil {
+            return fmt.Errorf("invalid broadcast address '%s'", bs)
+        }
+        c.bcastAddrs[i] = *b
+    }
+    return nil
+}
+
+// Parse a listen address in the form [address:]port, where an IPv6 address
+// must be in brackets. If only an address is given, the default port is used.
+func ParseListenAddr(s string) (string, error) {
+    if _, err := strconv.Atoi(s); err == nil {
+        s = ":" + s
+    }
+    host, port, err := net.SplitHostPort(s)
+    if err != nil {
+        // no port, but make sure a bare IPv6 address isn't mistaken for
+        // address:port
+        host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+        if strings.Contains(host, ":") && !strings.HasPrefix(s, "[") {
+            return "", fmt.Errorf("invalid listen address '%s', IPv6 addresses must be in brackets", s)
+        }
+        port = strconv.Itoa(defaultListenPort)
+    }
+    if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+        return "", fmt.Errorf("invalid listen address '%s': bad port '%s'", s, port)
+    }
+    if strings.ContainsAny(host, "[]") {
+        return "", fmt.Errorf("invalid listen address '%s'", s)
+    }
+    return net.JoinHostPort(host, port), nil
+}
+
+// Parse a line from the [hosts] section, in the form
+// <MAC> [<address>[:<port>]]
+func (c *Config) ParseHostLine(name, value string) (*HostConfig, error) {
+    fields := strings.Fields(value)
+    if len(fields) < 1 || len(fields) > 2 {
+        return nil, fmt.Errorf("invalid host %s: expected MAC [address[:port]]", name)
+    }
+
+    h := c.NewHostConfig(name)
+    h.MAC = fields[0]
+    if len(fields) == 2 {
+        addr, port, err := net.SplitHostPort(fields[1])
+        if err != nil {
+            // no port given, use the whole thing as the address
+            h.Address = strings.Trim(fields[1], "[]")
+        } else {
+            h.Address = addr
+            if h.Port, err = strconv.Atoi(port); err != nil {
+                return nil, fmt.Errorf("invalid host %s: bad port '%s'", name, port)
+            }
+        }
+    }
+    return h, nil
+}
+
+func (c *Config) NewHostConfig(name string) *HostConfig {
+    return &HostConfig{
+        Name:   name,
+        cfg:    c,
+        Port:   defaultProbePort,
+        Probe:  PROBE_AUTO,
+        WakePort: defaultPort,
+    }
+}
+
+func (h *HostConfig) Validate() error {
+    hw, err := ParseMAC(h.MAC)
+    if err != nil {
+        return fmt.Errorf("invalid host %s: bad MAC address '%s'", h.Name, h.MAC)
+    }
+    h.MAC = hw.String()
+    if h.Port < 1 || h.Port > 65535 {
+        return fmt.Errorf("invalid host %s: bad port %d", h.Name, h.Port)
+    }
+    if !validProbeMethod(h.Probe) {
+        return fmt.Errorf("invalid host %s: unknown probe method '%s'", h.Name, h.Probe)
+    }
+    if h.WaitTimeout < 0 {
+        return fmt.Errorf("invalid host %s: negative wait_timeout", h.Name)
+    }
+    if h.Transport != "" && !validTransport(h.Transport) {
+        return fmt.Errorf("invalid host %s: unknown transport '%s'", h.Name, h.Transport)
+    }
+    switch h.GetTransport() {
+        case TRANSPORT_ETHER:
+            if h.GetInterface() == "" {
+                return fmt.Errorf("invalid host %s: ether transport requires an interface", h.Name)
+            }
+        case TRANSPORT_UNICAST:
+            if h.Address == "" {
+                return fmt.Errorf("invalid host %s: unicast transport requires an address", h.Name)
+            }
+        case TRANSPORT_COMMAND:
+            if strings.TrimSpace(h.GetWakeCommand()) == "" {
+                return fmt.Errorf("invalid host %s: command transport requires a wake_command", h.Name)
+            }
+    }
+    if h.WakePort < 1 || h.WakePort > 65535 {
+        return fmt.Errorf("invalid host %s: bad wake_port %d", h.Name, h.WakePort)
+    }
+    if h.Source != "" && net.ParseIP(h.Source) == nil {
+        return fmt.Errorf("invalid host %s: bad source address '%s'", h.Name, h.Source)
+    }
+    if h.Password != "" {
+        if h.password, err = ParseSecureOnPassword(h.Password); err != nil {
+            return fmt.Errorf("invalid host %s: %v", h.Name, err)
+        }
+    }
+
+    h.bcastAddrs = make([]BroadcastAddr, len(h.BcastStrs))
+    for i, bs := range h.BcastStrs {
+        b := MakeBroadcastAddr(bs)
+        if b == nil {
+            return fmt.Errorf("invalid host %s: bad broadcast address '%s'", h.Name, bs)
+        }
+        h.bcastAddrs[i] = *b
+    }
+    return nil
+}
+
+func (h *HostConfig) GetTransport() string {
+    if h.Transport != "" {
+        return h.Transport
+    }
+    return h.cfg.Transport
+}
+
+func (h *HostConfig) GetInterface() string {
+    if h.Interface != "" {
+        return h.Interface
+    }
+    return h.cfg.Interface
+}
+
+func (h *HostConfig) GetWakeCommand() string {
+    if h.WakeCommand != "" {
+        return h.WakeCommand
+    }
+    return h.cfg.WakeCommand
+}
+
+// Broadcast addresses to wake this host, falling back to the global list
+func (h *HostConfig) BroadcastAddrs() []BroadcastAddr {
+    if len(h.bcastAddrs) > 0 {
+        return h.bcastAddrs
+    }
+    return h.cfg.bcastAddrs
 }
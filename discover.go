@@ -0,0 +1,307 @@
+/*******************************************************************************
+* discover.go: find hosts on the network to add to the config
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+    "text/tabwriter"
+)
+
+// lease files to check if none are configured, the last one is where
+// EdgeOS keeps its dhcpd leases
+var defaultLeaseFiles = []string{
+    "/var/lib/misc/dnsmasq.leases",
+    "/var/lib/dnsmasq/dnsmasq.leases",
+    "/var/lib/dhcp/dhcpd.leases",
+    "/config/dhcpd.leases",
+}
+
+// A host seen on the network
+type Neighbor struct {
+    MAC         string
+    IP          string
+    Hostname    string
+    Source      string  // where we found it: arp, neigh, or a lease file
+}
+
+// characters not allowed in generated host aliases
+var aliasBadChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Find hosts from the ARP table, kernel neighbor table, and DHCP lease files,
+// merged by MAC address. Errors reading individual sources are logged and
+// otherwise ignored.
+func Discover() []Neighbor {
+    byMAC := map[string]*Neighbor{}
+    add := func(n Neighbor) {
+        // skip placeholder entries for incomplete or permanent neighbors
+        if n.MAC == "00:00:00:00:00:00" || net.ParseIP(n.IP).IsUnspecified() {
+            return
+        }
+        if prev, ok := byMAC[n.MAC]; ok {
+            // keep the first IP and source, fill in a hostname if we didn't have one
+            if prev.Hostname == "" {
+                prev.Hostname = n.Hostname
+            }
+            if prev.IP == "" {
+                prev.IP = n.IP
+            }
+            return
+        }
+        byMAC[n.MAC] = &n
+    }
+
+    if arp, err := ReadARPTable(); err != nil {
+        log.Debug("Failed to read ARP table: %v", err)
+    } else {
+        for mac, ip := range arp {
+            add(Neighbor{MAC: mac, IP: ip, Source: "arp"})
+        }
+    }
+
+    if neigh, err := ReadNeighbors(); err != nil {
+        log.Debug("Failed to read neighbor table: %v", err)
+    } else {
+        for _, n := range neigh {
+            add(n)
+        }
+    }
+
+    for _, f := range leaseFiles() {
+        leases, err := ReadLeaseFile(f)
+        if err != nil {
+            logLeaseError(err)
+            continue
+        }
+        for _, n := range leases {
+            add(n)
+        }
+    }
+
+    list := make([]Neighbor, 0, len(byMAC))
+    for _, n := range byMAC {
+        list = append(list, *n)
+    }
+    sort.Slice(list, func(i, j int) bool {
+        a, b := net.ParseIP(list[i].IP), net.ParseIP(list[j].IP)
+        if c := bytes.Compare(a.To16(), b.To16()); c != 0 {
+            return c < 0
+        }
+        return list[i].MAC < list[j].MAC
+    })
+    return list
+}
+
+// Configured lease files, or the defaults if none are configured
+func leaseFiles() []string {
+    if files := Conf().LeaseFiles; len(files) > 0 {
+        return files
+    }
+    return defaultLeaseFiles
+}
+
+// Missing default lease files are expected, don't complain about them
+func logLeaseError(err error) {
+    if len(Conf().LeaseFiles) > 0 || !os.IsNotExist(err) {
+        log.Warning("Failed to read lease file: %v", err)
+    } else {
+        log.Debug("Failed to read lease file: %v", err)
+    }
+}
+
+// Read a DHCP lease file, either dnsmasq or ISC dhcpd format
+func ReadLeaseFile(path string) ([]Neighbor, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    if bytes.Contains(data, []byte("lease ")) && bytes.Contains(data, []byte("{")) {
+        return parseDhcpdLeases(bytes.NewReader(data), path), nil
+    }
+    return parseDnsmasqLeases(bytes.NewReader(data), path), nil
+}
+
+// dnsmasq leases are one per line: <expiry> <MAC> <IP> <hostname> <client-id>
+// with "*" for an unknown hostname
+func parseDnsmasqLeases(r io.Reader, source string) []Neighbor {
+    var leases []Neighbor
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 4 {
+            continue
+        }
+        hw, err := ParseMAC(fields[1])
+        if err != nil || net.ParseIP(fields[2]) == nil {
+            continue
+        }
+        n := Neighbor{MAC: hw.String(), IP: fields[2], Source: source}
+        if fields[3] != "*" {
+            n.Hostname = fields[3]
+        }
+        leases = append(leases, n)
+    }
+    return leases
+}
+
+// ISC dhcpd leases are blocks like
+//   lease 192.168.1.10 {
+//     binding state active;
+//     hardware ethernet aa:bb:cc:dd:ee:ff;
+//     client-hostname "desktop";
+//   }
+// Later blocks for the same IP replace earlier ones, and only active (or
+// stateless, for old versions) leases are kept.
+func parseDhcpdLeases(r io.Reader, source string) []Neighbor {
+    byIP := map[string]Neighbor{}
+    var order []string
+    var cur *Neighbor
+    var state string
+
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        line := strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";")
+        fields := strings.Fields(line)
+        switch {
+            case len(fields) == 3 && fields[0] == "lease" && fields[2] == "{":
+                cur = &Neighbor{IP: fields[1], Source: source}
+                state = ""
+            case cur == nil:
+                continue
+            case len(fields) == 3 && fields[0] == "hardware" && fields[1] == "ethernet":
+                if hw, err := ParseMAC(fields[2]); err == nil {
+                    cur.MAC = hw.String()
+                }
+            case len(fields) == 2 && fields[0] == "client-hostname":
+                cur.Hostname = strings.Trim(fields[1], "\"")
+            case len(fields) == 3 && fields[0] == "binding" && fields[1] == "state":
+                state = fields[2]
+            case line == "}":
+                if cur.MAC != "" && (state == "" || state == "active") {
+                    if _, ok := byIP[cur.IP]; !ok {
+                        order = append(order, cur.IP)
+                    }
+                    byIP[cur.IP] = *cur
+                } else {
+                    delete(byIP, cur.IP)
+                }
+                cur = nil
+        }
+    }
+
+    var leases []Neighbor
+    for _, ip := range order {
+        if n, ok := byIP[ip]; ok {
+            leases = append(leases, n)
+        }
+    }
+    return leases
+}
+
+// find the configured host alias for a MAC address, if any
+func hostByMAC(mac string) string {
+    for name, h := range Conf().Hosts {
+        if normalizeMAC(h.MAC) == mac {
+            return name
+        }
+    }
+    return ""
+}
+
+// make a host alias for a discovered host, from its hostname if possible
+func (n *Neighbor) Alias() string {
+    if alias := aliasBadChars.ReplaceAllString(strings.SplitN(n.Hostname, ".", 2)[0], "-"); alias != "" {
+        return strings.ToLower(alias)
+    }
+    return "host-" + strings.Replace(n.MAC, ":", "", -1)
+}
+
+// Run discovery and print the results to out. With ini, print [hosts]
+// entries ready to paste into the config file. Hosts that are already
+// configured are skipped unless all is true.
+func RunDiscover(out io.Writer, ini, all bool) {
+    var found []Neighbor
+    for _, n := range Discover() {
+        if all || hostByMAC(n.MAC) == "" {
+            found = append(found, n)
+        }
+    }
+
+    if ini {
+        // make sure generated aliases don't collide with each other, with
+        // configured hosts and groups, or with command names, which
+        // LoadConfig rejects
+        c := Conf()
+        used := map[string]bool{}
+        fmt.Fprintln(out, "[hosts]")
+        for _, n := range found {
+            taken := func(a string) bool {
+                _, isGroup := c.Groups[a]
+                return used[a] || c.Hosts[a] != nil || isGroup || FindCommand(a) != nil
+            }
+            alias := n.Alias()
+            for i := 2; taken(alias); i++ {
+                alias = fmt.Sprintf("%s-%d", n.Alias(), i)
+            }
+            used[alias] = true
+            fmt.Fprintf(out, "%s = %s %s\n", alias, n.MAC, n.IP)
+        }
+        return
+    }
+
+    if len(found) == 0 {
+        fmt.Fprintln(out, "No new hosts found")
+        return
+    }
+    tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+    fmt.Fprintln(tw, "HOSTNAME\tIP\tMAC\tSOURCE\tCONFIGURED")
+    for _, n := range found {
+        hostname, configured := n.Hostname, hostByMAC(n.MAC)
+        if hostname == "" {
+            hostname = "-"
+        }
+        if configured == "" {
+            configured = "-"
+        }
+        fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", hostname, n.IP, n.MAC, n.Source, configured)
+    }
+    tw.Flush()
+}
+
+// parse discover options shared by the SSH command and CLI subcommand
+func parseDiscoverArgs(args []string) (ini, all bool, err error) {
+    for _, a := range args {
+        switch a {
+            case "--ini":
+                ini = true
+            case "--all":
+                all = true
+            default:
+                return false, false, fmt.Errorf("Unknown option '%s'", a)
+        }
+    }
+    return ini, all, nil
+}
+
+func cmdDiscover(s *Session, args []string) byte {
+    ini, all, err := parseDiscoverArgs(args)
+    if err != nil {
+        fmt.Fprintln(s.Err, err)
+        return EXIT_USAGE
+    }
+    RunDiscover(s.Out, ini, all)
+    return EXIT_OK
+}
@@ -0,0 +1,66 @@
+/*******************************************************************************
+* ether_linux.go: send raw ethernet frames with AF_PACKET sockets
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "net"
+    "syscall"
+    "unsafe"
+)
+
+// EtherType for Wake on LAN frames
+const etherTypeWol uint16 = 0x0842
+
+// convert to network byte order, regardless of host endianness
+func htons(v uint16) uint16 {
+    var b [2]byte
+    binary.BigEndian.PutUint16(b[:], v)
+    return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+func rawSocketError(err error) error {
+    if err == syscall.EPERM || err == syscall.EACCES {
+        return fmt.Errorf("raw sockets require CAP_NET_RAW (run as root or use 'setcap cap_net_raw+ep')")
+    }
+    return err
+}
+
+// Check whether we're allowed to open AF_PACKET sockets
+func checkRawCapability() error {
+    fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, 0)
+    if err != nil {
+        return rawSocketError(err)
+    }
+    syscall.Close(fd)
+    return nil
+}
+
+// Send payload to dest on iface. The socket type is SOCK_DGRAM so the kernel
+// fills in the ethernet header. Protocol 0 means we never receive anything.
+func sendEtherFrame(iface string, dest net.HardwareAddr, payload []byte) error {
+    ifi, err := net.InterfaceByName(iface)
+    if err != nil {
+        return err
+    }
+
+    fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, 0)
+    if err != nil {
+        return rawSocketError(err)
+    }
+    defer syscall.Close(fd)
+
+    addr := syscall.SockaddrLinklayer{
+        Protocol:   htons(etherTypeWol),
+        Ifindex:    ifi.Index,
+        Halen:      uint8(len(dest)),
+    }
+    copy(addr.Addr[:], dest)
+    return syscall.Sendto(fd, payload, 0, &addr)
+}
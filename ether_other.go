@@ -0,0 +1,23 @@
+// +build !linux
+
+/*******************************************************************************
+* ether_other.go: stubs for raw ethernet frames
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "fmt"
+    "net"
+)
+
+func checkRawCapability() error {
+    return fmt.Errorf("raw ethernet is only supported on Linux")
+}
+
+func sendEtherFrame(iface string, dest net.HardwareAddr, payload []byte) error {
+    return checkRawCapability()
+}
@@ -0,0 +1,207 @@
+/*******************************************************************************
+* learn.go: remember the last-seen IP address of hosts configured by MAC only
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// how often to check lease files for changes
+const leasePollInterval = 30 * time.Second
+
+// an IP address seen for a MAC address
+type learnedAddr struct {
+    IP      string
+    Seen    time.Time
+}
+
+// IP addresses learned from the neighbor table and DHCP leases, keyed by
+// normalized MAC address. Only MACs of configured hosts without an address
+// are tracked.
+var learned = struct {
+    sync.Mutex
+    addrs   map[string]learnedAddr
+    dirty   bool
+}{addrs: map[string]learnedAddr{}}
+
+// The last IP address seen for a MAC, or empty if none is known
+func LearnedIP(mac string) string {
+    learned.Lock()
+    defer learned.Unlock()
+    return learned.addrs[normalizeMAC(mac)].IP
+}
+
+// whether any configured host needs its address learned
+func wantLearn(mac string) bool {
+    for _, h := range Conf().Hosts {
+        if h.Address == "" && h.MAC == mac {
+            return true
+        }
+    }
+    return false
+}
+
+// Record an IP for a MAC if it belongs to a host without an address
+func learnNeighbor(n Neighbor) {
+    // IPv4 is preferred, link-local IPv6 addresses aren't usable without a zone
+    ip := net.ParseIP(n.IP)
+    if ip == nil || ip.To4() == nil && ip.IsLinkLocalUnicast() || !wantLearn(n.MAC) {
+        return
+    }
+
+    learned.Lock()
+    defer learned.Unlock()
+    prev, ok := learned.addrs[n.MAC]
+    if ok && prev.IP != n.IP && net.ParseIP(prev.IP).To4() != nil && ip.To4() == nil {
+        // don't replace a known IPv4 address with IPv6
+        return
+    }
+    learned.addrs[n.MAC] = learnedAddr{IP: n.IP, Seen: time.Now()}
+    if ok && prev.IP == n.IP {
+        return
+    }
+    log.Info("Learned address %s for %s from %s", n.IP, n.MAC, n.Source)
+    learned.dirty = true
+}
+
+// Load learned addresses from the state file, which has lines of
+// <MAC> <IP> <unix time last seen>
+func loadLearned(path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    learned.Lock()
+    defer learned.Unlock()
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+            continue
+        }
+        hw, err := ParseMAC(fields[0])
+        if err != nil || net.ParseIP(fields[1]) == nil {
+            continue
+        }
+        seen, _ := strconv.ParseInt(fields[2], 10, 64)
+        learned.addrs[hw.String()] = learnedAddr{IP: fields[1], Seen: time.Unix(seen, 0)}
+    }
+    log.Debug("Loaded %d learned addresses from %s", len(learned.addrs), path)
+    return scanner.Err()
+}
+
+// Write learned addresses to the state file if they changed. The file is
+// replaced atomically so a crash can't leave it half written.
+func saveLearned(path string) error {
+    learned.Lock()
+    if !learned.dirty {
+        learned.Unlock()
+        return nil
+    }
+    macs := make([]string, 0, len(learned.addrs))
+    for mac := range learned.addrs {
+        macs = append(macs, mac)
+    }
+    sort.Strings(macs)
+    var sb strings.Builder
+    sb.WriteString("# wolssh learned host addresses: MAC IP last-seen\n")
+    for _, mac := range macs {
+        a := learned.addrs[mac]
+        fmt.Fprintf(&sb, "%s %s %d\n", mac, a.IP, a.Seen.Unix())
+    }
+    learned.dirty = false
+    learned.Unlock()
+
+    tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err = tmp.WriteString(sb.String()); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err = tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// Save learned addresses to the state file, if one is configured
+func SaveLearnedState() {
+    path := Conf().StateFile
+    if path == "" {
+        return
+    }
+    if err := saveLearned(path); err != nil {
+        log.Warning("Failed to save state file: %v", err)
+    }
+}
+
+// Start learning host addresses in the background: load the state file,
+// then follow the kernel neighbor table and poll DHCP lease files.
+func StartLearner() {
+    if path := Conf().StateFile; path != "" {
+        if err := loadLearned(path); err != nil && !os.IsNotExist(err) {
+            log.Warning("Failed to load state file: %v", err)
+        }
+    }
+
+    go func() {
+        if err := WatchNeighbors(learnNeighbor); err != nil {
+            log.Warning("Not watching the neighbor table: %v", err)
+        }
+    }()
+
+    go func() {
+        mtimes := map[string]time.Time{}
+        missing := map[string]bool{}
+        for {
+            for _, f := range leaseFiles() {
+                fi, err := os.Stat(f)
+                if err != nil {
+                    // only complain once until the file shows up
+                    if !missing[f] {
+                        missing[f] = true
+                        logLeaseError(err)
+                    }
+                    continue
+                }
+                delete(missing, f)
+                if prev, ok := mtimes[f]; ok && fi.ModTime().Equal(prev) {
+                    continue
+                }
+                mtimes[f] = fi.ModTime()
+                leases, err := ReadLeaseFile(f)
+                if err != nil {
+                    logLeaseError(err)
+                    continue
+                }
+                for _, n := range leases {
+                    learnNeighbor(n)
+                }
+            }
+            // writes are batched here rather than done for every
+            // neighbor update
+            SaveLearnedState()
+            time.Sleep(leasePollInterval)
+        }
+    }()
+}
@@ -0,0 +1,216 @@
+/*******************************************************************************
+* limit.go: brute-force protection and rate limits
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "fmt"
+    "net"
+    "sync"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+)
+
+const (
+    maxBackoff      = 64 * time.Second  // longest delay between failed logins before a ban
+    maxBanTime      = 24 * time.Hour    // repeated bans double up to this
+    forgetAfter     = 24 * time.Hour    // forget an IP's bans after this long without failures
+    sweepInterval   = time.Minute       // how often to drop expired IP records
+    wakeRateWindow  = time.Minute
+)
+
+// failed logins from one IP address
+type ipRecord struct {
+    failures    int         // since the last ban, or since failures expired
+    bans        int         // number of times banned, doubles the ban time
+    lastFail    time.Time
+    bannedUntil time.Time
+}
+
+// authLimiter tracks failed logins per source IP and the number of
+// handshakes in progress. Its state is kept across config reloads.
+type authLimiter struct {
+    mtx         sync.Mutex
+    ips         map[string]*ipRecord
+    attempted   map[string]bool     // handshakes that tried an auth method other than "none"
+    handshakes  int
+    full        bool                // whether handshakes are currently being refused
+    lastSweep   time.Time
+}
+
+func newAuthLimiter() *authLimiter {
+    return &authLimiter{
+        ips:        map[string]*ipRecord{},
+        attempted:  map[string]bool{},
+    }
+}
+
+// IP address part of a remote address, used as the key for failed logins
+func remoteIP(addr net.Addr) string {
+    if ip := addrIP(addr); ip != nil {
+        return ip.String()
+    }
+    return addr.String()
+}
+
+// Check whether to accept a connection from addr. Returns an error if the
+// address is banned or must wait longer after a failed login.
+func (l *authLimiter) allow(addr net.Addr) error {
+    now := time.Now()
+    l.mtx.Lock()
+    defer l.mtx.Unlock()
+    l.sweep(now)
+
+    r := l.ips[remoteIP(addr)]
+    if r == nil || Conf().MaxAuthFailures == 0 {
+        return nil
+    }
+    if now.Before(r.bannedUntil) {
+        return fmt.Errorf("banned for %v", r.bannedUntil.Sub(now).Round(time.Second))
+    }
+    if r.failures > 0 {
+        backoff := time.Second << uint(r.failures - 1)
+        if backoff > maxBackoff {
+            backoff = maxBackoff
+        }
+        if wait := r.lastFail.Add(backoff).Sub(now); wait > 0 {
+            return fmt.Errorf("backing off for %v after %d failed logins", wait.Round(time.Second), r.failures)
+        }
+    }
+    return nil
+}
+
+// drop records that no longer affect anything, at most once per sweepInterval
+func (l *authLimiter) sweep(now time.Time) {
+    if now.Sub(l.lastSweep) < sweepInterval {
+        return
+    }
+    l.lastSweep = now
+    for ip, r := range l.ips {
+        if now.After(r.bannedUntil) && now.Sub(r.lastFail) > forgetAfter {
+            delete(l.ips, ip)
+        }
+    }
+}
+
+// Start a handshake, returning false if too many are already in progress
+func (l *authLimiter) beginHandshake() bool {
+    max := Conf().MaxHandshakes
+    l.mtx.Lock()
+    defer l.mtx.Unlock()
+    if max > 0 && l.handshakes >= max {
+        // only warn once per burst of refused connections
+        if !l.full {
+            log.Warning("%d handshakes in progress, refusing new connections", l.handshakes)
+            l.full = true
+        }
+        return false
+    }
+    l.handshakes++
+    l.full = false
+    return true
+}
+
+// AuthLogCallback for the SSH server. Clients normally try "none" first to
+// get a list of methods, which doesn't count as a login attempt.
+func (l *authLimiter) authAttempt(conn ssh.ConnMetadata, method string, err error) {
+    if method == "none" || err == nil {
+        return
+    }
+    l.mtx.Lock()
+    defer l.mtx.Unlock()
+    l.attempted[conn.RemoteAddr().String()] = true
+}
+
+// Finish a handshake started with beginHandshake. A successful login clears
+// the address's failures, a failed login that tried to authenticate adds one
+// and may ban the address.
+func (l *authLimiter) handshakeDone(addr net.Addr, err error) {
+    now := time.Now()
+    c := Conf()
+    ip := remoteIP(addr)
+
+    l.mtx.Lock()
+    defer l.mtx.Unlock()
+    l.handshakes--
+    attempted := l.attempted[addr.String()]
+    delete(l.attempted, addr.String())
+
+    r := l.ips[ip]
+    if err == nil {
+        if r != nil {
+            r.failures = 0
+        }
+        return
+    }
+    if !attempted || c.MaxAuthFailures == 0 {
+        return
+    }
+
+    if r == nil {
+        r = &ipRecord{}
+        l.ips[ip] = r
+    }
+    banTime := time.Duration(c.BanTime) * time.Second
+    if now.Sub(r.lastFail) > banTime {
+        // earlier failures have expired
+        r.failures = 0
+    }
+    r.failures++
+    r.lastFail = now
+    if r.failures < c.MaxAuthFailures {
+        return
+    }
+
+    r.bans++
+    for i := 1; i < r.bans && banTime < maxBanTime; i++ {
+        banTime *= 2
+    }
+    if banTime > maxBanTime {
+        banTime = maxBanTime
+    }
+    r.bannedUntil = now.Add(banTime)
+    r.failures = 0
+    log.Warning("Banning %s for %v after %d failed logins", ip, banTime, c.MaxAuthFailures)
+}
+
+// times of recent wakes for each user, for wake_rate_limit
+var wakes = struct {
+    sync.Mutex
+    times   map[string][]time.Time
+}{times: map[string][]time.Time{}}
+
+// Record n wakes for a user. Returns false without recording anything if
+// that would take the user over wake_rate_limit wakes in the last minute.
+func allowWakes(user string, n int) bool {
+    limit := Conf().WakeRateLimit
+    if limit == 0 {
+        return true
+    }
+    now := time.Now()
+    wakes.Lock()
+    defer wakes.Unlock()
+
+    // drop wakes that have left the window
+    times := wakes.times[user]
+    i := 0
+    for i < len(times) && now.Sub(times[i]) >= wakeRateWindow {
+        i++
+    }
+    times = times[i:]
+
+    if len(times) + n > limit {
+        wakes.times[user] = times
+        return false
+    }
+    for ; n > 0; n-- {
+        times = append(times, now)
+    }
+    wakes.times[user] = times
+    return true
+}
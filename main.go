@@ -8,17 +8,17 @@
 package main
 
 import (
+    "context"
     "flag"
     "fmt"
     "os"
     "os/signal"
     "runtime"
-    "strings"
     "syscall"
+    "time"
 )
 
 var version string = "v0.0.0"
-var conf *Config
 var log Logger = Logger{
     Level:      3,
     Timestamp:  true,
@@ -50,8 +50,16 @@ func main() {
         os.Exit(0)
     }
 
+    // helpers for writing the config file, which don't need one loaded
+    switch flag.Arg(0) {
+        case "hash-password":
+            os.Exit(RunHashPassword(flag.Args()[1:]))
+        case "totp-secret":
+            os.Exit(RunTOTPSecret(flag.Args()[1:]))
+    }
+
     // load the config file
-    conf = DefaultConfig()
+    conf := DefaultConfig()
     if opts.confFile != "" {
         var err error
         conf, err = LoadConfig(opts.confFile)
@@ -59,6 +67,9 @@ func main() {
             fmt.Printf("Error parsing config file: %v\n", err)
             os.Exit(1)
         }
+    } else if err := conf.ParseGlobal(); err != nil {
+        fmt.Printf("Error in default config: %v\n", err)
+        os.Exit(1)
     }
 
     // logging setup
@@ -67,43 +78,86 @@ func main() {
         conf.Log.Level = int(LOG_LEVEL_DEBUG)
     }
     log.Level = LogLevel(conf.Log.Level)
+    setConf(conf)
 
     if conf.Log.Syslog {
         log.SetSyslog(conf.Log.Facility, conf.Log.Tag)
     } else if conf.Log.File != "" {
         log.SetLogFile(conf.Log.File)
-
-        // SIGHUP handler to reopen the log file (e.g. after rotation)
-        sighupChan := make(chan os.Signal, 1)
-        signal.Notify(sighupChan, syscall.SIGHUP)
-        go func() {
-            <-sighupChan
-            log.SetLogFile(conf.Log.File)
-            log.Info("Caught SIGHUP, log file reopened")
-        }()
     } else {
         // force enable stderr logging if no file or syslog given
         log.Stderr = true
     }
 
-    // parse and verify WOL broadcast addresses
-    conf.bcastAddrs = make([]BroadcastAddr, len(conf.BcastStrs))
-    for i, bs := range conf.BcastStrs {
-        b := MakeBroadcastAddr(bs)
-        if b != nil {
-            conf.bcastAddrs[i] = *b
-        } else {
-            log.Fatal("Invalid Broadcast address: %v", bs)
+    // "wolssh -c <config> discover [--ini] [--all]" prints discovered hosts
+    // and exits, without starting the server
+    if flag.Arg(0) == "discover" {
+        ini, all, err := parseDiscoverArgs(flag.Args()[1:])
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(int(EXIT_USAGE))
         }
+        RunDiscover(os.Stdout, ini, all)
+        os.Exit(0)
+    } else if flag.NArg() > 0 {
+        fmt.Printf("Unknown command '%s'\n", flag.Arg(0))
+        os.Exit(1)
     }
 
-    if !strings.Contains(conf.Listen, ":") {
-        conf.Listen = ":" + conf.Listen
-    }
+    checkTransports(conf)
+
 
     log.Info("Starting wolssh version %s", versionString())
+    StartLearner()
     server := NewServer()
-    server.LoadHostKeys(conf.HostKeys)
-    server.AddUsers(conf.Users)
-    server.Listen(conf.Listen)
+    if err := server.Load(conf); err != nil {
+        log.Fatal("%v", err)
+    }
+
+    // SIGHUP reloads the config file and reopens the log file (e.g. after
+    // rotation)
+    sighupChan := make(chan os.Signal, 1)
+    signal.Notify(sighupChan, syscall.SIGHUP)
+    go func() {
+        for range sighupChan {
+            log.Info("Caught SIGHUP, reloading")
+            ReloadConfig(server)
+        }
+    }()
+
+    // SIGTERM and SIGINT stop accepting connections and let running commands
+    // finish. A second signal exits immediately.
+    ctx, cancel := context.WithCancel(context.Background())
+    stopChan := make(chan os.Signal, 1)
+    signal.Notify(stopChan, syscall.SIGTERM, syscall.SIGINT)
+    go func() {
+        sig := <-stopChan
+        log.Info("Caught %v, shutting down", sig)
+        sdNotify("STOPPING=1")
+        cancel()
+        sig = <-stopChan
+        log.Error("Caught %v again, exiting now", sig)
+        log.Close()
+        os.Exit(1)
+    }()
+
+    // use sockets from systemd if we were socket activated
+    sockets, err := ActivationListeners()
+    if err != nil {
+        log.Fatal("%v", err)
+    }
+    if sockets != nil {
+        log.Info("Socket activated, ignoring listen addresses in the config")
+    } else if sockets, err = OpenListeners(conf.Listen); err != nil {
+        log.Fatal("%v", err)
+    }
+
+    sdNotify("READY=1")
+    sdStatus("Listening on %d sockets", len(sockets))
+    StartWatchdog(ctx)
+    server.Serve(ctx, sockets)
+    server.Shutdown(time.Duration(Conf().ShutdownTimeout) * time.Second)
+    SaveLearnedState()
+    log.Info("Shutdown complete")
+    log.Close()
 }
@@ -0,0 +1,144 @@
+/*******************************************************************************
+* neigh_linux.go: read the kernel neighbor table with netlink
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "encoding/binary"
+    "net"
+    "syscall"
+    "unsafe"
+)
+
+// from linux/neighbour.h
+const (
+    sizeofNdMsg     = 12
+    ndaDst          = 1
+    ndaLladdr       = 2
+    nudIncomplete   = 0x01
+    nudFailed       = 0x20
+    rtmgrpNeigh     = 0x4
+)
+
+// netlink messages use host byte order
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+    x := uint16(1)
+    if *(*byte)(unsafe.Pointer(&x)) == 1 {
+        return binary.LittleEndian
+    }
+    return binary.BigEndian
+}()
+
+// Dump the kernel neighbor table (like "ip neigh"), for both IPv4 and IPv6
+func ReadNeighbors() ([]Neighbor, error) {
+    data, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_UNSPEC)
+    if err != nil {
+        return nil, err
+    }
+    msgs, err := syscall.ParseNetlinkMessage(data)
+    if err != nil {
+        return nil, err
+    }
+
+    var neigh []Neighbor
+    for i := range msgs {
+        if n, ok := parseNeighMsg(&msgs[i]); ok {
+            neigh = append(neigh, n)
+        }
+    }
+    return neigh, nil
+}
+
+// Call fn for every entry in the neighbor table, then for each new or
+// updated entry as the kernel reports them. Only returns on error.
+func WatchNeighbors(fn func(Neighbor)) error {
+    fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+    if err != nil {
+        return err
+    }
+    defer syscall.Close(fd)
+    // subscribe before dumping the table so no updates are missed in between
+    if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpNeigh}); err != nil {
+        return err
+    }
+
+    neigh, err := ReadNeighbors()
+    if err != nil {
+        return err
+    }
+    for _, n := range neigh {
+        fn(n)
+    }
+
+    buf := make([]byte, syscall.Getpagesize())
+    for {
+        nr, _, err := syscall.Recvfrom(fd, buf, 0)
+        if err == syscall.EINTR {
+            continue
+        } else if err == syscall.ENOBUFS {
+            // the kernel dropped updates, they'll be picked up next time
+            // the entry changes
+            log.Debug("neighbor updates overflowed")
+            continue
+        } else if err != nil {
+            return err
+        }
+        msgs, err := syscall.ParseNetlinkMessage(buf[:nr])
+        if err != nil {
+            log.Debug("bad netlink message: %v", err)
+            continue
+        }
+        for i := range msgs {
+            if n, ok := parseNeighMsg(&msgs[i]); ok {
+                fn(n)
+            }
+        }
+    }
+}
+
+// Parse an RTM_NEWNEIGH message: a struct ndmsg followed by rtattrs.
+// Returns false for other messages and for entries without a usable
+// IP and MAC.
+func parseNeighMsg(m *syscall.NetlinkMessage) (Neighbor, bool) {
+    if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < sizeofNdMsg {
+        return Neighbor{}, false
+    }
+    state := nativeEndian.Uint16(m.Data[8:10])
+    if state & (nudIncomplete | nudFailed) != 0 {
+        return Neighbor{}, false
+    }
+
+    var ip net.IP
+    var mac net.HardwareAddr
+    attrs := m.Data[sizeofNdMsg:]
+    for len(attrs) >= syscall.SizeofRtAttr {
+        alen := int(nativeEndian.Uint16(attrs[0:2]))
+        atype := nativeEndian.Uint16(attrs[2:4])
+        if alen < syscall.SizeofRtAttr || alen > len(attrs) {
+            break
+        }
+        val := attrs[syscall.SizeofRtAttr:alen]
+        switch atype {
+            case ndaDst:
+                ip = net.IP(append([]byte{}, val...))
+            case ndaLladdr:
+                mac = net.HardwareAddr(append([]byte{}, val...))
+        }
+
+        // attributes are padded to 4 bytes
+        next := (alen + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+        if next > len(attrs) {
+            break
+        }
+        attrs = attrs[next:]
+    }
+
+    if ip == nil || len(mac) != 6 || ip.IsMulticast() || mac[0] & 1 != 0 {
+        return Neighbor{}, false
+    }
+    return Neighbor{MAC: mac.String(), IP: ip.String(), Source: "neigh"}, true
+}
@@ -0,0 +1,22 @@
+// +build !linux
+
+/*******************************************************************************
+* neigh_other.go: stub for reading the kernel neighbor table
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "fmt"
+)
+
+func ReadNeighbors() ([]Neighbor, error) {
+    return nil, fmt.Errorf("reading the neighbor table is only supported on Linux")
+}
+
+func WatchNeighbors(fn func(Neighbor)) error {
+    return fmt.Errorf("watching the neighbor table is only supported on Linux")
+}
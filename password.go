@@ -0,0 +1,277 @@
+/*******************************************************************************
+* password.go: password hashes and TOTP codes for interactive logins
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "bufio"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/base64"
+    "encoding/binary"
+    "fmt"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+    "golang.org/x/term"
+)
+
+// argon2id parameters for new hashes. Memory is kept modest since wolssh
+// often runs on small routers.
+const (
+    argon2Time      = 2
+    argon2Memory    = 19 * 1024     // KiB
+    argon2Threads   = 1
+    argon2SaltLen   = 16
+    argon2KeyLen    = 32
+
+    // limits for hashes from the config file, so that one login attempt
+    // can't use all the memory or CPU on a small router
+    argon2MaxMemory = 64 * 1024     // KiB
+    argon2MaxTime   = 16
+)
+
+// RFC 6238 parameters, the defaults used by authenticator apps
+const (
+    totpPeriod      = 30
+    totpDigits      = 6
+    totpSkew        = 1     // accept codes this many periods early or late
+    totpSecretLen   = 20
+)
+
+var b64 = base64.RawStdEncoding
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// a user's password login settings
+type passwordAuth struct {
+    hash    string
+    totp    []byte  // nil if TOTP isn't required
+}
+
+// a parsed argon2 PHC string, $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+type argon2Hash struct {
+    variant         string
+    time, memory    uint32
+    threads         uint8
+    salt, key       []byte
+}
+
+func parseArgon2Hash(s string) (*argon2Hash, error) {
+    parts := strings.Split(s, "$")
+    if len(parts) != 6 || parts[0] != "" || (parts[1] != "argon2id" && parts[1] != "argon2i") {
+        return nil, fmt.Errorf("invalid argon2 hash")
+    }
+    h := argon2Hash{variant: parts[1]}
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return nil, fmt.Errorf("unsupported argon2 version '%s'", parts[2])
+    }
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+        return nil, fmt.Errorf("invalid argon2 parameters '%s'", parts[3])
+    }
+    // argon2 panics on too few rounds or threads, or too little memory
+    if h.time < 1 || h.threads < 1 || h.memory < 8 * uint32(h.threads) {
+        return nil, fmt.Errorf("argon2 parameters '%s' too small", parts[3])
+    }
+    if h.time > argon2MaxTime || h.memory > argon2MaxMemory {
+        return nil, fmt.Errorf("argon2 parameters '%s' too large, limits are m=%d,t=%d",
+                               parts[3], argon2MaxMemory, argon2MaxTime)
+    }
+    var err error
+    if h.salt, err = b64.DecodeString(parts[4]); err != nil || len(h.salt) == 0 {
+        return nil, fmt.Errorf("invalid argon2 salt")
+    }
+    if h.key, err = b64.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+        return nil, fmt.Errorf("invalid argon2 hash")
+    }
+    return &h, nil
+}
+
+func (h *argon2Hash) derive(password string) []byte {
+    if h.variant == "argon2i" {
+        return argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+    }
+    return argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+}
+
+// Check that a password_hash value is a bcrypt or argon2 hash we can verify
+func ValidatePasswordHash(hash string) error {
+    if strings.HasPrefix(hash, "$argon2") {
+        _, err := parseArgon2Hash(hash)
+        return err
+    }
+    if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+        return fmt.Errorf("password hash must be bcrypt or argon2: %v", err)
+    }
+    return nil
+}
+
+// Check a password against a bcrypt or argon2 hash
+func VerifyPassword(hash, password string) bool {
+    if strings.HasPrefix(hash, "$argon2") {
+        h, err := parseArgon2Hash(hash)
+        if err != nil {
+            return false
+        }
+        return subtle.ConstantTimeCompare(h.derive(password), h.key) == 1
+    }
+    return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Hash a password with argon2id
+func HashPassword(password string) (string, error) {
+    h := argon2Hash{
+        variant:    "argon2id",
+        time:       argon2Time,
+        memory:     argon2Memory,
+        threads:    argon2Threads,
+        salt:       make([]byte, argon2SaltLen),
+        key:        make([]byte, argon2KeyLen),
+    }
+    if _, err := rand.Read(h.salt); err != nil {
+        return "", err
+    }
+    h.key = h.derive(password)
+    return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.time,
+                      h.threads, b64.EncodeToString(h.salt), b64.EncodeToString(h.key)), nil
+}
+
+// Decode a base32 TOTP secret, ignoring case, spaces, and padding
+func ParseTOTPSecret(s string) ([]byte, error) {
+    s = strings.ToUpper(strings.TrimRight(strings.Replace(s, " ", "", -1), "="))
+    secret, err := b32.DecodeString(s)
+    if err != nil || len(secret) < 10 {
+        return nil, fmt.Errorf("invalid TOTP secret, must be at least 16 base32 characters")
+    }
+    return secret, nil
+}
+
+// The TOTP code for a time step, RFC 6238 with HMAC-SHA1
+func totpCode(secret []byte, counter uint64) string {
+    var msg [8]byte
+    binary.BigEndian.PutUint64(msg[:], counter)
+    mac := hmac.New(sha1.New, secret)
+    mac.Write(msg[:])
+    sum := mac.Sum(nil)
+
+    // dynamic truncation, RFC 4226 section 5.3
+    offset := sum[len(sum)-1] & 0xf
+    value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", totpDigits, value % 1000000)
+}
+
+// Check a TOTP code, returning the time step it matched so that the caller
+// can reject reuse. Returns false if it doesn't match any step within the
+// allowed clock skew.
+func CheckTOTP(secret []byte, code string, now time.Time) (uint64, bool) {
+    code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+    step := uint64(now.Unix()) / totpPeriod
+    for c := step - totpSkew; c <= step + totpSkew; c++ {
+        if subtle.ConstantTimeCompare([]byte(totpCode(secret, c)), []byte(code)) == 1 {
+            return c, true
+        }
+    }
+    return 0, false
+}
+
+// read a password from the terminal without echo, or a line from stdin if
+// it's not a terminal
+func readPassword(prompt string) (string, error) {
+    fd := int(os.Stdin.Fd())
+    if !term.IsTerminal(fd) {
+        line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+        if err != nil && line == "" {
+            return "", err
+        }
+        return strings.TrimRight(line, "\r\n"), nil
+    }
+    fmt.Fprint(os.Stderr, prompt)
+    pw, err := term.ReadPassword(fd)
+    fmt.Fprintln(os.Stderr)
+    return string(pw), err
+}
+
+// "wolssh hash-password [--bcrypt]" prints a password_hash for the config
+func RunHashPassword(args []string) int {
+    useBcrypt := false
+    for _, a := range args {
+        if a == "--bcrypt" {
+            useBcrypt = true
+        } else {
+            fmt.Fprintf(os.Stderr, "Unknown option '%s'\n", a)
+            return int(EXIT_USAGE)
+        }
+    }
+
+    pw, err := readPassword("Password: ")
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to read password: %v\n", err)
+        return 1
+    }
+    if term.IsTerminal(int(os.Stdin.Fd())) {
+        again, err := readPassword("Confirm password: ")
+        if err != nil || again != pw {
+            fmt.Fprintln(os.Stderr, "Passwords don't match")
+            return 1
+        }
+    }
+    if pw == "" {
+        fmt.Fprintln(os.Stderr, "Empty password")
+        return 1
+    }
+
+    var hash string
+    if useBcrypt {
+        var b []byte
+        b, err = bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+        hash = string(b)
+    } else {
+        hash, err = HashPassword(pw)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to hash password: %v\n", err)
+        return 1
+    }
+    fmt.Printf("password_hash = %s\n", hash)
+    return 0
+}
+
+// "wolssh totp-secret [user]" prints a new totp_secret for the config and an
+// otpauth:// URI to add it to an authenticator app
+func RunTOTPSecret(args []string) int {
+    if len(args) > 1 {
+        fmt.Fprintln(os.Stderr, "Usage: wolssh totp-secret [user]")
+        return int(EXIT_USAGE)
+    }
+    account := "wolssh"
+    if len(args) == 1 {
+        account = "wolssh:" + args[0]
+    }
+
+    secret := make([]byte, totpSecretLen)
+    if _, err := rand.Read(secret); err != nil {
+        fmt.Fprintf(os.Stderr, "Failed to generate secret: %v\n", err)
+        return 1
+    }
+    encoded := b32.EncodeToString(secret)
+    uri := url.URL{
+        Scheme:     "otpauth",
+        Host:       "totp",
+        Path:       "/" + account,
+        RawQuery:   url.Values{"secret": {encoded}, "issuer": {"wolssh"}}.Encode(),
+    }
+    fmt.Printf("totp_secret = %s\n", encoded)
+    fmt.Printf("# add to an authenticator app with this URI (or as a QR code):\n# %s\n", uri.String())
+    return 0
+}
@@ -0,0 +1,276 @@
+/*******************************************************************************
+* probe.go: check whether hosts are up
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// default TCP port to probe, most hosts worth waking run sshd
+const defaultProbePort int = 22
+
+const (
+    // timeout for a single connection attempt
+    probeTimeout    = 2 * time.Second
+    // how often to probe while waiting for a host to come up
+    probeInterval   = 2 * time.Second
+    // how often to print a progress message while waiting
+    progressInterval = 10 * time.Second
+)
+
+// methods for checking whether a host is up
+const (
+    PROBE_AUTO  = "auto"    // TCP if an address is configured, then ARP
+    PROBE_TCP   = "tcp"     // TCP connection to the configured address only
+    PROBE_ARP   = "arp"     // ARP table lookup only
+    PROBE_NONE  = "none"    // never probe
+)
+
+var probeMethods = [...]string{PROBE_AUTO, PROBE_TCP, PROBE_ARP, PROBE_NONE}
+
+func validProbeMethod(m string) bool {
+    for _, pm := range probeMethods {
+        if m == pm {
+            return true
+        }
+    }
+    return false
+}
+
+// kernel ARP table, used to find hosts by MAC address
+const arpTablePath = "/proc/net/arp"
+
+// ATF_COM flag in the ARP table, set for completed entries
+const arpFlagComplete = 0x2
+
+type HostState int
+
+const (
+    HOST_UNKNOWN HostState = iota
+    HOST_DOWN
+    HOST_UP
+)
+
+var hostStateStrings = [...]string{"unknown", "down", "up"}
+
+func (s HostState) String() string {
+    return hostStateStrings[s]
+}
+
+// result of checking a host, Detail describes how the state was determined
+type HostStatus struct {
+    State   HostState
+    Detail  string
+}
+
+func (st HostStatus) String() string {
+    if st.Detail == "" {
+        return st.State.String()
+    }
+    return fmt.Sprintf("%s (%s)", st.State, st.Detail)
+}
+
+// Address to probe, either configured or learned from the network
+func (h *HostConfig) ProbeHost() string {
+    if h.Address != "" {
+        return h.Address
+    }
+    return LearnedIP(h.MAC)
+}
+
+func (h *HostConfig) ProbeAddr() string {
+    return net.JoinHostPort(h.ProbeHost(), strconv.Itoa(h.Port))
+}
+
+// Check whether we can wait for this host to come up, which requires a TCP
+// probe since ARP entries can be stale. Returns the reason if we can't.
+func (h *HostConfig) CanWait() error {
+    if h.Probe != PROBE_AUTO && h.Probe != PROBE_TCP {
+        return fmt.Errorf("probe method is '%s', waiting needs '%s' or '%s'", h.Probe, PROBE_AUTO, PROBE_TCP)
+    }
+    if h.ProbeHost() == "" {
+        return fmt.Errorf("no address configured or learned for TCP probes")
+    }
+    return nil
+}
+
+// How long to wait for this host by default
+func (h *HostConfig) WaitTime() time.Duration {
+    if h.WaitTimeout > 0 {
+        return time.Duration(h.WaitTimeout) * time.Second
+    }
+    return time.Duration(h.cfg.WaitTimeout) * time.Second
+}
+
+// Try to connect to a TCP address. A refused connection counts as success,
+// since the host must be up to send the RST.
+func ProbeTCP(addr string, timeout time.Duration) bool {
+    conn, err := net.DialTimeout("tcp", addr, timeout)
+    if err == nil {
+        conn.Close()
+        return true
+    }
+    return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// Probe a host until it responds or the deadline passes, writing progress
+// messages to out. Returns true if the host came up. Gives up early if
+// writing to out fails, i.e. the client disconnected.
+func WaitForHost(h *HostConfig, deadline time.Time, out io.Writer) bool {
+    start := time.Now()
+    lastProgress := start
+    addr := h.ProbeAddr()
+    fmt.Fprintf(out, "Waiting for host %s (%s) to come up\n", h.Name, addr)
+
+    for {
+        attempt := time.Now()
+        if ProbeTCP(addr, probeTimeout) {
+            fmt.Fprintf(out, "Host %s is up after %ds\n", h.Name, int(time.Since(start).Seconds()))
+            return true
+        }
+
+        now := time.Now()
+        if now.After(deadline) {
+            fmt.Fprintf(out, "Host %s did not come up after %ds\n", h.Name, int(now.Sub(start).Seconds()))
+            return false
+        }
+        if now.Sub(lastProgress) >= progressInterval {
+            lastProgress = now
+            if _, err := fmt.Fprintf(out, "Still waiting for host %s (%ds)\n", h.Name, int(now.Sub(start).Seconds())); err != nil {
+                log.Debug("stopped waiting for %s: %v", h.Name, err)
+                return false
+            }
+        }
+        time.Sleep(time.Until(attempt.Add(probeInterval)))
+    }
+}
+
+// Normalize a MAC address to lowercase colon-separated form, returning the
+// input unchanged if it can't be parsed.
+func normalizeMAC(mac string) string {
+    hw, err := ParseMAC(mac)
+    if err != nil {
+        return mac
+    }
+    return hw.String()
+}
+
+// Read the kernel ARP table, returning a map of MAC address to IP address
+// for all complete entries.
+func ReadARPTable() (map[string]string, error) {
+    f, err := os.Open(arpTablePath)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    table := map[string]string{}
+    scanner := bufio.NewScanner(f)
+    scanner.Scan() // skip header line
+    for scanner.Scan() {
+        // IP address, HW type, Flags, HW address, Mask, Device
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 4 {
+            continue
+        }
+        flags, err := strconv.ParseUint(fields[2], 0, 32)
+        if err != nil || flags & arpFlagComplete == 0 {
+            continue
+        }
+        table[normalizeMAC(fields[3])] = fields[0]
+    }
+    return table, scanner.Err()
+}
+
+// Check whether a host is up using its configured probe method.
+// For PROBE_AUTO, if the host has a configured or learned address try a TCP
+// probe, and a failed probe of a configured address means the host is down.
+// Otherwise look for its MAC in the ARP table and probe the IP found there.
+// An ARP entry alone isn't proof that a host is up since entries linger for
+// minutes after a machine powers off, so it only makes the state unknown.
+func CheckHost(h *HostConfig, arp map[string]string) HostStatus {
+    host := h.ProbeHost()
+    probeAddr := net.JoinHostPort(host, strconv.Itoa(h.Port))
+    switch h.Probe {
+        case PROBE_NONE:
+            return HostStatus{HOST_UNKNOWN, "probing disabled"}
+
+        case PROBE_TCP:
+            if host == "" {
+                return HostStatus{HOST_UNKNOWN, "no address"}
+            } else if ProbeTCP(probeAddr, probeTimeout) {
+                return HostStatus{HOST_UP, "tcp " + probeAddr}
+            }
+            return HostStatus{HOST_DOWN, "tcp " + probeAddr}
+
+        case PROBE_ARP:
+            if ip, ok := arp[normalizeMAC(h.MAC)]; ok {
+                return HostStatus{HOST_UP, "arp " + ip}
+            }
+            return HostStatus{HOST_DOWN, "not in ARP table"}
+    }
+
+    if host != "" {
+        if ProbeTCP(probeAddr, probeTimeout) {
+            return HostStatus{HOST_UP, "tcp " + probeAddr}
+        }
+        if h.Address != "" {
+            return HostStatus{HOST_DOWN, "tcp " + probeAddr}
+        }
+    }
+
+    // no configured address, and the learned address (if any) didn't answer
+    ip, ok := arp[normalizeMAC(h.MAC)]
+    if !ok {
+        if host != "" {
+            return HostStatus{HOST_DOWN, "tcp " + probeAddr}
+        }
+        return HostStatus{HOST_UNKNOWN, "no address and not in ARP table"}
+    }
+    if ip != host {
+        addr := net.JoinHostPort(ip, strconv.Itoa(h.Port))
+        if ProbeTCP(addr, probeTimeout) {
+            return HostStatus{HOST_UP, "tcp " + addr}
+        }
+    }
+    return HostStatus{HOST_UNKNOWN, "in ARP table as " + ip + " but not answering"}
+}
+
+// Check several hosts in parallel, returning a map of host name to status.
+func CheckHosts(hosts []*HostConfig) map[string]HostStatus {
+    arp, err := ReadARPTable()
+    if err != nil {
+        log.Debug("Failed to read ARP table: %v", err)
+    }
+
+    var mtx sync.Mutex
+    var wg sync.WaitGroup
+    results := make(map[string]HostStatus, len(hosts))
+    for _, h := range hosts {
+        wg.Add(1)
+        go func(h *HostConfig) {
+            defer wg.Done()
+            st := CheckHost(h, arp)
+            mtx.Lock()
+            results[h.Name] = st
+            mtx.Unlock()
+        }(h)
+    }
+    wg.Wait()
+    return results
+}
@@ -0,0 +1,196 @@
+/*******************************************************************************
+* reload.go: reload the config file while running
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "reflect"
+    "sort"
+    "sync/atomic"
+    "time"
+)
+
+// the running config, replaced as a whole on reload. Loaded configs are
+// never modified, so callers can hold on to the result of Conf() for as
+// long as they need a consistent view.
+var currentConf atomic.Value
+
+func Conf() *Config {
+    c, _ := currentConf.Load().(*Config)
+    return c
+}
+
+func setConf(c *Config) {
+    currentConf.Store(c)
+}
+
+// Warn early about transports that won't work
+func checkTransports(c *Config) {
+    // raw ethernet needs extra privileges
+    for _, h := range c.Hosts {
+        if h.GetTransport() == TRANSPORT_ETHER {
+            if err := checkRawCapability(); err != nil {
+                log.Warning("Raw ethernet transport won't work: %v", err)
+            }
+            break
+        }
+    }
+}
+
+// Re-read the config file and apply it to the running server. If the new
+// config is invalid, it's rejected and the old one stays in effect.
+// Connections that are already open keep their users' old permissions.
+func ReloadConfig(server *Server) {
+    sdNotify("RELOADING=1")
+    defer sdNotify("READY=1")
+    old := Conf()
+    if opts.confFile == "" {
+        reopenLogFile(old)
+        return
+    }
+
+    c, err := LoadConfig(opts.confFile)
+    if err == nil {
+        err = server.Load(c)
+    }
+    if err != nil {
+        // still reopen the log file, which may have been rotated
+        reopenLogFile(old)
+        log.Error("Failed to reload config, keeping the old one: %v", err)
+        sdStatus("Failed to reload config: %v", err)
+        return
+    }
+
+    // settings that are only applied at startup
+    if !reflect.DeepEqual(c.Listen, old.Listen) {
+        log.Warning("Listen addresses changed, restart to apply them")
+        c.Listen = old.Listen
+    }
+    if opts.debug {
+        c.Log.Level = int(LOG_LEVEL_DEBUG)
+    }
+    if c.Log != old.Log {
+        log.Warning("Log settings changed, restart to apply them")
+        c.Log = old.Log
+    }
+    if c.StateFile != old.StateFile {
+        log.Warning("state_file changed, restart to apply it")
+        c.StateFile = old.StateFile
+    }
+
+    setConf(c)
+    reopenLogFile(c)
+    checkTransports(c)
+    logConfigDiff(old, c)
+    log.Info("Config reloaded from %s", opts.confFile)
+    sdStatus("Config reloaded at %s", time.Now().Format("2006-01-02 15:04:05"))
+}
+
+// Reopen the log file (e.g. after rotation), if logging to one. As in main,
+// the file is only used when syslog is off.
+func reopenLogFile(c *Config) {
+    if !c.Log.Syslog && c.Log.File != "" {
+        log.SetLogFile(c.Log.File)
+    }
+}
+
+// Log what changed between two configs
+func logConfigDiff(old, c *Config) {
+    if !reflect.DeepEqual(old.BcastStrs, c.BcastStrs) {
+        log.Info("Broadcast addresses changed: %v -> %v", old.BcastStrs, c.BcastStrs)
+    }
+    if !reflect.DeepEqual(old.HostKeys, c.HostKeys) {
+        log.Info("Host keys changed: %v -> %v", old.HostKeys, c.HostKeys)
+    }
+    if !reflect.DeepEqual(old.TrustedCAs, c.TrustedCAs) {
+        log.Info("Trusted CAs changed: %d -> %d keys", len(old.TrustedCAs), len(c.TrustedCAs))
+    }
+    if old.RevokedKeys != c.RevokedKeys {
+        log.Info("revoked_keys changed: %q -> %q", old.RevokedKeys, c.RevokedKeys)
+    }
+    if old.AuthorizedKeysFile != c.AuthorizedKeysFile {
+        log.Info("authorized_keys_file changed: %q -> %q", old.AuthorizedKeysFile, c.AuthorizedKeysFile)
+    }
+    if old.WaitTimeout != c.WaitTimeout || old.ShutdownTimeout != c.ShutdownTimeout ||
+       old.Transport != c.Transport ||
+       old.Interface != c.Interface || old.WakeCommand != c.WakeCommand ||
+       !reflect.DeepEqual(old.LeaseFiles, c.LeaseFiles) ||
+       old.HandshakeTimeout != c.HandshakeTimeout || old.MaxHandshakes != c.MaxHandshakes ||
+       old.MaxAuthFailures != c.MaxAuthFailures || old.BanTime != c.BanTime ||
+       old.WakeRateLimit != c.WakeRateLimit ||
+       !reflect.DeepEqual(old.AllowFrom, c.AllowFrom) || !reflect.DeepEqual(old.DenyFrom, c.DenyFrom) ||
+       !reflect.DeepEqual(old.ProxyFrom, c.ProxyFrom) {
+        log.Info("Global settings changed")
+    }
+
+    added, removed, changed := diffKeys(hostMap(old), hostMap(c))
+    logDiff("host", added, removed, changed)
+    added, removed, changed = diffKeys(groupMap(old), groupMap(c))
+    logDiff("group", added, removed, changed)
+    added, removed, changed = diffKeys(userMap(old), userMap(c))
+    logDiff("user", added, removed, changed)
+}
+
+func logDiff(what string, added, removed, changed []string) {
+    for _, name := range added {
+        log.Info("Added %s %s", what, name)
+    }
+    for _, name := range removed {
+        log.Info("Removed %s %s", what, name)
+    }
+    for _, name := range changed {
+        log.Info("Changed %s %s", what, name)
+    }
+}
+
+// The maps below hold comparable copies of config entries, since hosts
+// point back to their config and would always differ.
+func hostMap(c *Config) map[string]interface{} {
+    m := map[string]interface{}{}
+    for name, h := range c.Hosts {
+        hc := *h
+        hc.cfg = nil
+        m[name] = hc
+    }
+    return m
+}
+
+func groupMap(c *Config) map[string]interface{} {
+    m := map[string]interface{}{}
+    for name, g := range c.Groups {
+        m[name] = g
+    }
+    return m
+}
+
+func userMap(c *Config) map[string]interface{} {
+    m := map[string]interface{}{}
+    for _, u := range c.Users {
+        m[u.Name] = u
+    }
+    return m
+}
+
+// sorted keys added to, removed from, and changed between two maps
+func diffKeys(old, cur map[string]interface{}) (added, removed, changed []string) {
+    for k, v := range cur {
+        if ov, ok := old[k]; !ok {
+            added = append(added, k)
+        } else if !reflect.DeepEqual(ov, v) {
+            changed = append(changed, k)
+        }
+    }
+    for k := range old {
+        if _, ok := cur[k]; !ok {
+            removed = append(removed, k)
+        }
+    }
+    sort.Strings(added)
+    sort.Strings(removed)
+    sort.Strings(changed)
+    return
+}
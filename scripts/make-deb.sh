@@ -39,6 +39,7 @@ if [[ $INIT == sysv ]]; then
     install -Dm755 debian/wolssh.init $datadir/etc/init.d/wolssh
 else # systemd
     install -Dm644 debian/wolssh.service $datadir/lib/systemd/system/wolssh.service
+    install -Dm644 debian/wolssh.socket $datadir/lib/systemd/system/wolssh.socket
 fi
 tar --owner=root:0 --group=root:0 -czf $tmpdir/data.tar.gz -C $datadir .
 
@@ -8,48 +8,274 @@
 package main
 
 import (
+    "context"
     "fmt"
-    "io"
     "io/ioutil"
     "net"
     "path/filepath"
     "reflect"
+    "strings"
+    "sync"
+    "time"
 
     "golang.org/x/crypto/ssh"
 )
 
 type Server struct {
-    config      ssh.ServerConfig
-    userKeys    map[string]map[string]string
+    config          *ssh.ServerConfig
+    userKeys        map[string]map[string]*authorizedKey
+    userKeyFiles    map[string]*keyFile
+    userPerms       map[string]map[string]string    // ssh.Permissions extensions
+    userPasswords   map[string]*passwordAuth
+    userFilters     map[string]*AddrFilter          // allow_from/deny_from
+    certAuth        *certAuth
+    mtx             sync.RWMutex
+
+    // last TOTP time step used by each user, kept across reloads to stop
+    // codes being reused
+    totpUsed        map[string]uint64
+    totpMtx         sync.Mutex
+
+    // failed logins and handshakes in progress, also kept across reloads
+    limiter         *authLimiter
+
+    // open connections and running commands, for shutdown
+    conns           map[net.Conn]bool
+    running         int
+    draining        bool
+    idle            chan struct{}                   // closed when draining and no commands are running
+    connMtx         sync.Mutex
 }
 
 func NewServer() (*Server) {
-    s := Server{
-        config:     ssh.ServerConfig{},
-        userKeys:   map[string]map[string]string{},
+    return &Server{
+        conns:      map[net.Conn]bool{},
+        idle:       make(chan struct{}),
+        totpUsed:   map[string]uint64{},
+        limiter:    newAuthLimiter(),
+    }
+}
+
+// Load host keys and users from a config. Nothing is changed unless
+// everything loads successfully, so this is safe to call on a running server.
+// Existing connections keep the settings they were authenticated with.
+func (s *Server) Load(c *Config) error {
+    config := &ssh.ServerConfig{
+        PublicKeyCallback:  s.authPublicKey,
+        AuthLogCallback:    s.limiter.authAttempt,
+    }
+    if err := loadHostKeys(config, c.HostKeys); err != nil {
+        return err
+    }
+
+    ca, err := newCertAuth(c)
+    if err != nil {
+        return err
     }
-    s.config.PublicKeyCallback = s.authPublicKey
 
-    return &s
+    userKeys := map[string]map[string]*authorizedKey{}
+    userKeyFiles := map[string]*keyFile{}
+    userPerms := map[string]map[string]string{}
+    userPasswords := map[string]*passwordAuth{}
+    userFilters := map[string]*AddrFilter{}
+    for _, u := range c.Users {
+        userFilters[u.Name] = u.sourceFilter
+        if u.PasswordHash != "" {
+            // already validated by LoadConfig
+            pw := &passwordAuth{hash: u.PasswordHash}
+            pw.totp, _ = ParseTOTPSecret(u.TOTPSecret)
+            userPasswords[u.Name] = pw
+            // only offer password auth methods if someone can use them
+            config.PasswordCallback = s.authPassword
+            config.KeyboardInteractiveCallback = s.authKeyboardInteractive
+        }
+
+        keysPath := u.AuthorizedKeysFile
+        if keysPath == "" {
+            keysPath = c.AuthorizedKeysFile
+        }
+        var kf *keyFile
+        if keysPath != "" {
+            kf = &keyFile{path: expandKeyFilePath(keysPath, u.Name)}
+        }
+        keys, err := parseUserKeys(u.Name, u.Keys, kf != nil || ca.trusts(u.Name) || u.PasswordHash != "")
+        if err != nil {
+            return err
+        }
+        if userKeys[u.Name] != nil {
+            log.Warning("Duplicate user %q, overwriting keys", u.Name)
+        }
+        userKeys[u.Name] = keys
+        if kf != nil {
+            kf.Keys()
+            userKeyFiles[u.Name] = kf
+        }
+
+        allow, err := c.ExpandAllow(u.Allow)
+        if err != nil {
+            return fmt.Errorf("invalid allow list for user %q: %v", u.Name, err)
+        }
+        log.Debug("User %q may wake hosts %v", u.Name, allow)
+        userPerms[u.Name] = UserPermissions(&u, allow)
+    }
+
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.config = config
+    s.userKeys = userKeys
+    s.userKeyFiles = userKeyFiles
+    s.userPerms = userPerms
+    s.userPasswords = userPasswords
+    s.userFilters = userFilters
+    s.certAuth = ca
+    return nil
+}
+
+// current SSH config, copied by each new connection's handshake
+func (s *Server) sshConfig() *ssh.ServerConfig {
+    s.mtx.RLock()
+    defer s.mtx.RUnlock()
+    return s.config
 }
 
 func (s *Server) authPublicKey(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+    s.mtx.RLock()
+    defer s.mtx.RUnlock()
     user := conn.User()
     if keys, ok := s.userKeys[user]; ok {
-        if comment, ok := keys[string(pubKey.Marshal())]; ok {
-            return &ssh.Permissions{
+        if !s.userFilters[user].Permits(conn.RemoteAddr()) {
+            return nil, fmt.Errorf("connection from %v: user %q not allowed from this address", conn.RemoteAddr(), user)
+        }
+        var perms *ssh.Permissions
+        if cert, ok := pubKey.(*ssh.Certificate); ok {
+            var err error
+            if perms, err = s.certAuth.authenticate(user, cert); err != nil {
+                return nil, fmt.Errorf("connection from %v: %v", conn.RemoteAddr(), err)
+            }
+        } else if key := s.findKey(user, keys, pubKey); key != nil {
+            if s.certAuth.revoked(pubKey) {
+                return nil, fmt.Errorf("connection from %v: revoked public key for %q", conn.RemoteAddr(), user)
+            }
+            if err := key.check(conn.RemoteAddr()); err != nil {
+                return nil, fmt.Errorf("connection from %v: public key %q for %q: %v", conn.RemoteAddr(), key.comment, user, err)
+            }
+            perms = &ssh.Permissions{
                 Extensions: map[string]string{
                     "pubkey-fp": ssh.FingerprintSHA256(pubKey),
-                    "pubkey-comment": comment,
+                    "pubkey-comment": key.comment,
                 },
-            }, nil
+            }
+            key.apply(perms)
+        }
+        if perms != nil {
+            for k, v := range s.userPerms[user] {
+                perms.Extensions[k] = v
+            }
+            return perms, nil
         }
         return nil, fmt.Errorf("connection from %v: unknown public key for %q", conn.RemoteAddr(), user)
     }
     return nil, fmt.Errorf("connection from %v: unknown user %q", conn.RemoteAddr(), user)
 }
 
-func (s *Server) LoadHostKeys(paths []string) {
+// Password login for users without TOTP, who must use keyboard-interactive
+func (s *Server) authPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+    user := conn.User()
+    pw, perms, err := s.passwordUser(conn)
+    if err != nil {
+        return nil, err
+    }
+    if pw.totp != nil {
+        return nil, fmt.Errorf("connection from %v: user %q needs a verification code, password auth refused", conn.RemoteAddr(), user)
+    }
+    if !VerifyPassword(pw.hash, string(password)) {
+        return nil, fmt.Errorf("connection from %v: wrong password for %q", conn.RemoteAddr(), user)
+    }
+    perms.Extensions["auth-method"] = "password"
+    return perms, nil
+}
+
+// Keyboard-interactive login, asking for a password and then a TOTP code if
+// the user has a TOTP secret
+func (s *Server) authKeyboardInteractive(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+    user := conn.User()
+    pw, perms, err := s.passwordUser(conn)
+    if err != nil {
+        return nil, err
+    }
+
+    answers, err := client("", "", []string{"Password: "}, []bool{false})
+    if err != nil {
+        return nil, err
+    }
+    if len(answers) != 1 || !VerifyPassword(pw.hash, answers[0]) {
+        return nil, fmt.Errorf("connection from %v: wrong password for %q", conn.RemoteAddr(), user)
+    }
+    perms.Extensions["auth-method"] = "password"
+
+    if pw.totp != nil {
+        answers, err = client("", "", []string{"Verification code: "}, []bool{false})
+        if err != nil {
+            return nil, err
+        }
+        if len(answers) != 1 || !s.checkTOTP(user, pw.totp, answers[0]) {
+            return nil, fmt.Errorf("connection from %v: wrong verification code for %q", conn.RemoteAddr(), user)
+        }
+        perms.Extensions["auth-method"] = "password+totp"
+    }
+    return perms, nil
+}
+
+// A user's password settings and a copy of their permissions, or an error if
+// the user has no password or isn't allowed from the client's address. The
+// server lock isn't held during authentication since the client can take its
+// time answering prompts.
+func (s *Server) passwordUser(conn ssh.ConnMetadata) (*passwordAuth, *ssh.Permissions, error) {
+    s.mtx.RLock()
+    defer s.mtx.RUnlock()
+    user := conn.User()
+    pw := s.userPasswords[user]
+    if pw == nil {
+        return nil, nil, fmt.Errorf("connection from %v: no password for %q", conn.RemoteAddr(), user)
+    }
+    if !s.userFilters[user].Permits(conn.RemoteAddr()) {
+        return nil, nil, fmt.Errorf("connection from %v: user %q not allowed from this address", conn.RemoteAddr(), user)
+    }
+    perms := &ssh.Permissions{Extensions: map[string]string{}}
+    for k, v := range s.userPerms[user] {
+        perms.Extensions[k] = v
+    }
+    return pw, perms, nil
+}
+
+// check a TOTP code, rejecting codes that were already used
+func (s *Server) checkTOTP(user string, secret []byte, code string) bool {
+    step, ok := CheckTOTP(secret, code, time.Now())
+    if !ok {
+        return false
+    }
+    s.totpMtx.Lock()
+    defer s.totpMtx.Unlock()
+    if step <= s.totpUsed[user] {
+        log.Warning("Reused TOTP code for %q", user)
+        return false
+    }
+    s.totpUsed[user] = step
+    return true
+}
+
+// find a user's public key, from the config or their authorized_keys file
+func (s *Server) findKey(user string, keys map[string]*authorizedKey, pubKey ssh.PublicKey) *authorizedKey {
+    if key, ok := keys[string(pubKey.Marshal())]; ok {
+        return key
+    }
+    if kf := s.userKeyFiles[user]; kf != nil {
+        return kf.Keys()[string(pubKey.Marshal())]
+    }
+    return nil
+}
+
+func loadHostKeys(config *ssh.ServerConfig, paths []string) error {
     // key types we've found (map to avoid duplicates)
     foundKeys := map[string]bool{}
     for _, p := range paths {
@@ -64,81 +290,160 @@ func (s *Server) LoadHostKeys(paths []string) {
             key, err := ssh.ParsePrivateKey(keyData)
             if err != nil {
                 log.Error("Failed to parse private key '%s': %s", keyPath, err)
+                continue
             }
 
-            s.config.AddHostKey(key)
+            config.AddHostKey(key)
             foundKeys[key.PublicKey().Type()] = true
             log.Debug("Loaded host key %s", keyPath)
         }
     }
 
     if len(foundKeys) == 0 {
-        log.Fatal("Couldn't find any host keys!")
+        return fmt.Errorf("Couldn't find any host keys!")
     }
 
     // reflect is the only non-loopy way to get a list of keys from a map,
     // and even then it returns []reflect.Value rather than a string slice
     // (and there's no comprehension to compactly convert []Value to []string)
     log.Info("Loaded SSH host keys: %v", reflect.ValueOf(foundKeys).MapKeys())
+    return nil
 }
 
-func (s *Server) AddUser(name string, keys []string) {
+// Parse a user's pubkey lines from the config. hasOther suppresses the
+// warning for users who log in with an authorized_keys file or certificates.
+func parseUserKeys(name string, keys []string, hasOther bool) (map[string]*authorizedKey, error) {
     log.Debug("Adding user %q with %d keys", name, len(keys))
-    keyMap := make(map[string]string)
-
-    for _, key := range keys {
-        data := []byte(key)
-        for len(data) > 0 {
-            pubKey, comment, _, rest, err := ssh.ParseAuthorizedKey(data)
-            if err != nil {
-                log.Fatal("failed to parse key for user %q: %v", name, err)
-            }
-            log.Debug("Loaded authorized public key for user %q: %q", name, comment)
-            keyMap[string(pubKey.Marshal())] = comment
-            data = rest
-        }
+    keyMap, err := parseAuthorizedKeys(fmt.Sprintf("pubkey for user %q", name), strings.Join(keys, "\n"), true)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse key: %v", err)
+    }
+    for _, k := range keyMap {
+        log.Debug("Loaded authorized public key for user %q: %q", name, k.comment)
     }
 
-    if len(keyMap) == 0 {
+    if len(keyMap) == 0 && !hasOther {
         log.Warning("No authorized keys for user %q", name)
     } else {
         log.Info("Loaded %d authorized keys for user %q", len(keyMap), name)
     }
+    return keyMap, nil
+}
 
-    if s.userKeys[name] != nil {
-        log.Warning("Duplicate user %q, overwriting keys", name)
+// Bind all listen addresses. If any fails, the others are closed so that
+// the server isn't left half up.
+func OpenListeners(listenAddrs []string) ([]net.Listener, error) {
+    var sockets []net.Listener
+    for _, addr := range listenAddrs {
+        socket, err := net.Listen(listenNetwork(addr), addr)
+        if err != nil {
+            for _, sock := range sockets {
+                sock.Close()
+            }
+            return nil, fmt.Errorf("Failed to listen on socket: %s", err)
+        }
+        sockets = append(sockets, socket)
     }
-    s.userKeys[name] = keyMap
+    return sockets, nil
 }
 
-func (s *Server) AddUsers(users []UserConfig) {
-    for _, u := range users {
-        s.AddUser(u.Name, u.Keys)
+// Accept connections on all sockets until ctx is cancelled. Connections that
+// are already open are left alone, use Shutdown to close them.
+func (s *Server) Serve(ctx context.Context, sockets []net.Listener) {
+    var wg sync.WaitGroup
+    for _, socket := range sockets {
+        wg.Add(1)
+        go func(socket net.Listener) {
+            defer wg.Done()
+            s.serve(ctx, socket)
+        }(socket)
     }
+    wg.Wait()
 }
 
-func (s *Server) Listen(listenAddr string) {
-    socket, err := net.Listen("tcp", listenAddr)
-    if err != nil {
-        log.Fatal("Failed to listen on socket: %s", err)
+// Listen on IPv4 addresses with tcp4 and IPv6 with tcp6, so that 0.0.0.0 and
+// [::] can be used together. A bare port or hostname listens on both.
+func listenNetwork(addr string) string {
+    host, _, _ := net.SplitHostPort(addr)
+    if ip := net.ParseIP(host); ip != nil {
+        if ip.To4() != nil {
+            return "tcp4"
+        }
+        return "tcp6"
     }
+    return "tcp"
+}
+
+func (s *Server) serve(ctx context.Context, socket net.Listener) {
+    go func() {
+        <-ctx.Done()
+        socket.Close()
+    }()
 
+    listenAddr := socket.Addr()
     log.Info("listening on %s", listenAddr)
     for {
         conn, err := socket.Accept()
         if err != nil {
+            if ctx.Err() != nil {
+                log.Info("Stopped listening on %s", listenAddr)
+                return
+            }
             log.Debug("Error accepting connection: %v", err)
             continue
         }
-        log.Info("Connection from %v", conn.RemoteAddr())
+        // connections through a proxy are checked once the PROXY header
+        // gives the real client address
+        proxied := netsContain(Conf().proxyNets, addrIP(conn.RemoteAddr()))
+        if !proxied && !s.admit(conn) {
+            continue
+        }
+
+        go func(conn net.Conn) {
+            if !s.trackConn(conn) {
+                conn.Close()
+                return
+            }
+            defer s.untrackConn(conn)
+
+            if proxied {
+                proxy := conn.RemoteAddr()
+                if timeout := Conf().HandshakeTimeout; timeout > 0 {
+                    conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+                }
+                pc, err := ReadProxyHeader(conn)
+                if err != nil {
+                    log.Warning("Bad PROXY header from %v: %v", proxy, err)
+                    conn.Close()
+                    return
+                }
+                log.Debug("Proxy %v forwarded connection from %v", proxy, pc.RemoteAddr())
+                if conn = pc; !s.admit(conn) {
+                    return
+                }
+            }
 
-        go func() {
-            sshConn, chans, reqs, err := ssh.NewServerConn(conn, &s.config)
+            // refuse new handshakes while too many are in progress, and
+            // don't let a handshake take forever
+            if !s.limiter.beginHandshake() {
+                conn.Close()
+                return
+            }
+            if timeout := Conf().HandshakeTimeout; timeout > 0 {
+                conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+            }
+            sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig())
+            s.limiter.handshakeDone(conn.RemoteAddr(), err)
             if err != nil {
                 log.Error("SSH Handshake error: %v", err)
                 return
             }
-            log.Info("Authenticated as user %s with key (%s)", sshConn.User(), sshConn.Permissions.Extensions["pubkey-comment"])
+            if method := sshConn.Permissions.Extensions["auth-method"]; method != "" {
+                log.Info("Authenticated as user %s with %s", sshConn.User(), method)
+            } else {
+                log.Info("Authenticated as user %s with key (%s)", sshConn.User(), sshConn.Permissions.Extensions["pubkey-comment"])
+            }
+            conn.SetDeadline(time.Time{})
 
             go ssh.DiscardRequests(reqs)
             for newChannel := range chans {
@@ -153,38 +458,191 @@ func (s *Server) Listen(listenAddr string) {
                     continue
                 }
 
-                go handleChannelRequests(channel, requests)
+                go s.handleChannelRequests(channel, requests, sshConn)
             }
-        }()
+        }(conn)
+    }
+}
+
+// Check a new connection against allow_from/deny_from and failed logins,
+// closing it if it's refused. Refusals are logged at debug level, since a
+// refused client can retry as fast as it likes.
+func (s *Server) admit(conn net.Conn) bool {
+    if !Conf().sourceFilter.Permits(conn.RemoteAddr()) {
+        log.Debug("Refusing connection from %v: not allowed by allow_from/deny_from", conn.RemoteAddr())
+        conn.Close()
+        return false
+    }
+    if err := s.limiter.allow(conn.RemoteAddr()); err != nil {
+        log.Debug("Refusing connection from %v: %v", conn.RemoteAddr(), err)
+        conn.Close()
+        return false
+    }
+    log.Info("Connection from %v", conn.RemoteAddr())
+    return true
+}
+
+// returns false if the server is shutting down
+func (s *Server) trackConn(conn net.Conn) bool {
+    s.connMtx.Lock()
+    defer s.connMtx.Unlock()
+    if s.draining {
+        return false
+    }
+    s.conns[conn] = true
+    return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+    s.connMtx.Lock()
+    defer s.connMtx.Unlock()
+    delete(s.conns, conn)
+}
+
+// Mark the start of a command. Returns false if the server is shutting down,
+// in which case the command shouldn't run.
+func (s *Server) beginCommand() bool {
+    s.connMtx.Lock()
+    defer s.connMtx.Unlock()
+    if s.draining {
+        return false
+    }
+    s.running++
+    return true
+}
+
+func (s *Server) endCommand() {
+    s.connMtx.Lock()
+    defer s.connMtx.Unlock()
+    s.running--
+    if s.draining && s.running == 0 {
+        close(s.idle)
+    }
+}
+
+// Stop running new commands, wait up to timeout for running commands to
+// finish, then close all connections. Call after Serve has returned.
+func (s *Server) Shutdown(timeout time.Duration) {
+    s.connMtx.Lock()
+    s.draining = true
+    running := s.running
+    if running == 0 {
+        close(s.idle)
+    }
+    s.connMtx.Unlock()
+
+    if running > 0 {
+        log.Info("Waiting up to %v for %d running commands", timeout, running)
+        sdStatus("Waiting for %d running commands", running)
+        select {
+            case <-s.idle:
+            case <-time.After(timeout):
+                log.Warning("Timed out waiting for running commands")
+        }
+    }
+
+    s.connMtx.Lock()
+    defer s.connMtx.Unlock()
+    if len(s.conns) > 0 {
+        log.Info("Closing %d connections", len(s.conns))
+    }
+    for conn := range s.conns {
+        conn.Close()
+    }
+}
+
+func sendExitStatus(channel ssh.Channel, status byte) {
+    channel.SendRequest("exit-status", false, []byte{0, 0, 0, status})
+}
+
+// Run a single command and send its exit status. If the user's key is
+// restricted to a command, that's run instead.
+func (s *Server) runExec(channel ssh.Channel, sshConn *ssh.ServerConn, command string) {
+    if forced := PermsForceCommand(sshConn.Permissions); forced != "" {
+        log.Info("user %s forced command '%s' (requested '%s')", sshConn.User(), forced, command)
+        command = forced
+    }
+    session := Session{
+        User:   sshConn.User(),
+        Perms:  sshConn.Permissions,
+        Out:    channel,
+        Err:    channel.Stderr(),
+    }
+    if !s.beginCommand() {
+        fmt.Fprintln(session.Err, "Server is shutting down")
+        sendExitStatus(channel, EXIT_UNAVAILABLE)
+        return
     }
+    // send the exit status before ending the command, since ending the last
+    // command lets Shutdown close the connection
+    sendExitStatus(channel, session.RunCommand(command))
+    s.endCommand()
 }
 
-func handleChannelRequests(channel ssh.Channel, reqs <-chan *ssh.Request) {
+func (s *Server) handleChannelRequests(channel ssh.Channel, reqs <-chan *ssh.Request, sshConn *ssh.ServerConn) {
     defer channel.Close()
+    shell := NewShell(channel, sshConn, s)
+    started := false
     for req := range reqs {
-        exitStatus := byte(1)
-        ok := false
         switch req.Type {
             case "exec":
-                cmd := string(req.Payload[4:4+req.Payload[3]])
-                log.Info("request to execute command '%s'", cmd)
-                var resp string
-                resp, exitStatus = HandleWolCmd(cmd)
-                io.WriteString(channel, fmt.Sprintf("%s\n", resp))
-                ok = true
+                var execReq struct{ Command string }
+                if err := ssh.Unmarshal(req.Payload, &execReq); err != nil || started {
+                    log.Error("invalid exec request")
+                    req.Reply(false, nil)
+                    continue
+                }
+                log.Info("user %s request to execute command '%s'", sshConn.User(), execReq.Command)
+                req.Reply(true, nil)
+                s.runExec(channel, sshConn, execReq.Command)
+                return
+
+            case "pty-req":
+                var pty ptyRequest
+                if err := ssh.Unmarshal(req.Payload, &pty); err != nil || started {
+                    log.Error("invalid pty request")
+                    req.Reply(false, nil)
+                    continue
+                }
+                if !PermsAllowPty(sshConn.Permissions) {
+                    log.Info("user %s pty request denied by key options", sshConn.User())
+                    req.Reply(false, nil)
+                    continue
+                }
+                log.Debug("pty request: %s %dx%d", pty.Term, pty.Columns, pty.Rows)
+                shell.SetPty(&pty)
+                req.Reply(true, nil)
+
+            case "window-change":
+                var wc windowChange
+                if err := ssh.Unmarshal(req.Payload, &wc); err != nil {
+                    log.Error("invalid window-change request: %v", err)
+                    continue
+                }
+                shell.Resize(wc.Columns, wc.Rows)
 
             case "shell":
-                log.Info("request shell")
-                io.WriteString(channel, "Sorry, you requested a shell, but that's not allowed.\n" )
-                ok = true
+                if started {
+                    req.Reply(false, nil)
+                    continue
+                }
+                log.Info("user %s request shell", sshConn.User())
+                req.Reply(true, nil)
+                if PermsForceCommand(sshConn.Permissions) != "" {
+                    s.runExec(channel, sshConn, "")
+                    return
+                }
+                started = true
+                // keep handling requests (i.e. window-change) while the
+                // shell runs, closing the channel ends this loop.
+                go func() {
+                    sendExitStatus(channel, shell.Run())
+                    channel.Close()
+                }()
 
             default:
-                log.Info("request unknown channel type: %s", req.Type)
-        }
-        req.Reply(ok, nil)
-        channel.SendRequest("exit-status", false, []byte{0, 0, 0, exitStatus})
-        if ok {
-            return
+                log.Debug("rejecting channel request type: %s", req.Type)
+                req.Reply(false, nil)
         }
     }
 }
@@ -0,0 +1,223 @@
+/*******************************************************************************
+* shell.go: interactive restricted shell
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+    "sync"
+
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/term"
+)
+
+// payload of a pty-req channel request, RFC 4254 section 6.2
+type ptyRequest struct {
+    Term        string
+    Columns     uint32
+    Rows        uint32
+    Width       uint32
+    Height      uint32
+    Modes       string
+}
+
+// payload of a window-change channel request, RFC 4254 section 6.7
+type windowChange struct {
+    Columns     uint32
+    Rows        uint32
+    Width       uint32
+    Height      uint32
+}
+
+// terminal size to use if the client doesn't report one
+const (
+    defaultColumns  = 80
+    defaultRows     = 24
+)
+
+// Shell is an interactive session on an SSH channel, offering the same
+// commands as exec requests.
+type Shell struct {
+    channel     ssh.Channel
+    session     Session
+    pty         *ptyRequest
+    term        *term.Terminal
+    server      *Server
+    mtx         sync.Mutex
+}
+
+func NewShell(channel ssh.Channel, sshConn *ssh.ServerConn, server *Server) *Shell {
+    return &Shell{
+        channel:    channel,
+        server:     server,
+        session:    Session{
+            User:   sshConn.User(),
+            Perms:  sshConn.Permissions,
+        },
+    }
+}
+
+// Handle a pty-req. Must be called before Run.
+func (sh *Shell) SetPty(pty *ptyRequest) {
+    sh.mtx.Lock()
+    defer sh.mtx.Unlock()
+    sh.pty = pty
+}
+
+// Handle a window-change, which can happen at any time.
+func (sh *Shell) Resize(columns, rows uint32) {
+    sh.mtx.Lock()
+    defer sh.mtx.Unlock()
+    if sh.pty != nil {
+        sh.pty.Columns = columns
+        sh.pty.Rows = rows
+    }
+    if sh.term != nil {
+        sh.setTermSize(columns, rows)
+    }
+}
+
+func (sh *Shell) setTermSize(columns, rows uint32) {
+    if columns == 0 {
+        columns = defaultColumns
+    }
+    if rows == 0 {
+        rows = defaultRows
+    }
+    sh.term.SetSize(int(columns), int(rows))
+}
+
+// Run the shell until the user exits or the channel is closed, returning
+// the exit status of the last command.
+func (sh *Shell) Run() byte {
+    sh.mtx.Lock()
+    if sh.pty == nil {
+        sh.mtx.Unlock()
+        return sh.runNoPty()
+    }
+
+    prompt := fmt.Sprintf("%s@wolssh> ", sh.session.User)
+    t := term.NewTerminal(sh.channel, prompt)
+    t.AutoCompleteCallback = sh.complete
+    sh.term = t
+    sh.setTermSize(sh.pty.Columns, sh.pty.Rows)
+    sh.mtx.Unlock()
+
+    sh.session.Out = t
+    sh.session.Err = t
+    fmt.Fprintf(t, "wolssh version %s\n", version)
+    fmt.Fprintln(t, "Type 'help' for a list of commands, 'exit' to quit.")
+
+    status := EXIT_OK
+    for {
+        line, err := t.ReadLine()
+        if err != nil {
+            if err != io.EOF {
+                log.Debug("shell read error: %v", err)
+            }
+            return status
+        }
+        if done := sh.runLine(line, &status); done {
+            return status
+        }
+    }
+}
+
+// without a pty, read commands one per line with no prompt or echo so
+// that e.g. "echo list | ssh -T wol@router" works
+func (sh *Shell) runNoPty() byte {
+    sh.session.Out = sh.channel
+    sh.session.Err = sh.channel.Stderr()
+
+    status := EXIT_OK
+    scanner := bufio.NewScanner(sh.channel)
+    for scanner.Scan() {
+        if done := sh.runLine(scanner.Text(), &status); done {
+            break
+        }
+    }
+    return status
+}
+
+// run a line of input, returning true if the shell should exit
+func (sh *Shell) runLine(line string, status *byte) bool {
+    line = strings.TrimSpace(line)
+    switch line {
+        case "":
+            return false
+        case "exit", "quit", "logout":
+            return true
+    }
+    log.Info("user %s shell command '%s'", sh.session.User, line)
+    if !sh.server.beginCommand() {
+        fmt.Fprintln(sh.session.Err, "Server is shutting down")
+        *status = EXIT_UNAVAILABLE
+        return true
+    }
+    *status = sh.session.RunCommand(line)
+    sh.server.endCommand()
+    return false
+}
+
+// tab completion for the terminal. The first word completes command names,
+// later words complete host aliases and groups the user is allowed to wake.
+func (sh *Shell) complete(line string, pos int, key rune) (string, int, bool) {
+    if key != '\t' {
+        return "", 0, false
+    }
+
+    start := strings.LastIndexAny(line[:pos], " \t") + 1
+    prefix := line[start:pos]
+
+    var candidates []string
+    if strings.TrimSpace(line[:start]) == "" {
+        for _, c := range commands {
+            if !c.Admin || PermsAdmin(sh.session.Perms) {
+                candidates = append(candidates, c.Name)
+            }
+        }
+    } else {
+        for name := range Conf().Hosts {
+            if PermsAllowHost(sh.session.Perms, name) {
+                candidates = append(candidates, name)
+            }
+        }
+        candidates = append(candidates, allowedGroups(sh.session.Perms)...)
+    }
+
+    var matches []string
+    for _, c := range candidates {
+        if strings.HasPrefix(c, prefix) {
+            matches = append(matches, c)
+        }
+    }
+    if len(matches) == 0 {
+        return "", 0, false
+    }
+    sort.Strings(matches)
+
+    // complete up to the longest common prefix, plus a space if unique
+    completion := matches[0]
+    for _, m := range matches[1:] {
+        for !strings.HasPrefix(m, completion) {
+            completion = completion[:len(completion)-1]
+        }
+    }
+    if len(matches) == 1 {
+        completion += " "
+    }
+    if completion == prefix {
+        return "", 0, false
+    }
+
+    newLine := line[:start] + completion + line[pos:]
+    return newLine, start + len(completion), true
+}
@@ -0,0 +1,232 @@
+/*******************************************************************************
+* source.go: client address filtering and the PROXY protocol
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// AddrFilter is a list of networks to allow and deny. An address is permitted
+// if it's not denied and either the allow list is empty or it's allowed.
+type AddrFilter struct {
+    allow   []*net.IPNet
+    deny    []*net.IPNet
+}
+
+// Parse a list of addresses in CIDR notation. A plain IP address matches only
+// itself.
+func ParseNets(list []string) ([]*net.IPNet, error) {
+    var nets []*net.IPNet
+    for _, s := range list {
+        s = strings.TrimSpace(s)
+        if s == "" {
+            continue
+        }
+        if !strings.Contains(s, "/") {
+            ip := net.ParseIP(s)
+            if ip == nil {
+                return nil, fmt.Errorf("invalid address '%s'", s)
+            }
+            bits := 128
+            if ip4 := ip.To4(); ip4 != nil {
+                ip, bits = ip4, 32
+            }
+            nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, n, err := net.ParseCIDR(s)
+        if err != nil {
+            return nil, fmt.Errorf("invalid network '%s'", s)
+        }
+        nets = append(nets, n)
+    }
+    return nets, nil
+}
+
+// Parse allow_from and deny_from lists. Returns nil if both are empty.
+func ParseAddrFilter(allow, deny []string) (*AddrFilter, error) {
+    var f AddrFilter
+    var err error
+    if f.allow, err = ParseNets(allow); err != nil {
+        return nil, fmt.Errorf("allow_from: %v", err)
+    }
+    if f.deny, err = ParseNets(deny); err != nil {
+        return nil, fmt.Errorf("deny_from: %v", err)
+    }
+    if len(f.allow) == 0 && len(f.deny) == 0 {
+        return nil, nil
+    }
+    return &f, nil
+}
+
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+    for _, n := range nets {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// Whether a connection from addr is permitted. A nil filter permits
+// everything.
+func (f *AddrFilter) Permits(addr net.Addr) bool {
+    if f == nil {
+        return true
+    }
+    ip := addrIP(addr)
+    if ip == nil || netsContain(f.deny, ip) {
+        return false
+    }
+    return len(f.allow) == 0 || netsContain(f.allow, ip)
+}
+
+// IP address of a connection, with IPv4-mapped IPv6 addresses converted to
+// IPv4 so they match IPv4 networks
+func addrIP(addr net.Addr) net.IP {
+    var ip net.IP
+    if tcp, ok := addr.(*net.TCPAddr); ok {
+        ip = tcp.IP
+    } else if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+        ip = net.ParseIP(host)
+    }
+    if ip4 := ip.To4(); ip4 != nil {
+        return ip4
+    }
+    return ip
+}
+
+// PROXY protocol, see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const proxyV1MaxLen = 107   // including CRLF
+
+// proxyConn is a connection that arrived through a proxy, with the remote
+// address taken from the PROXY header
+type proxyConn struct {
+    net.Conn
+    r       *bufio.Reader   // may hold data read past the header
+    remote  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+    return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+    return c.remote
+}
+
+// Read a PROXY protocol v1 or v2 header from a connection, returning a
+// connection whose RemoteAddr is the real client's. For health checks (v1
+// UNKNOWN or v2 LOCAL) the proxy's own address is kept.
+func ReadProxyHeader(conn net.Conn) (net.Conn, error) {
+    r := bufio.NewReader(conn)
+    // 12 bytes is the v2 signature, and shorter than any v1 header
+    start, err := r.Peek(len(proxyV2Sig))
+    if err != nil {
+        return nil, fmt.Errorf("reading PROXY header: %v", err)
+    }
+
+    var remote net.Addr
+    switch {
+        case bytes.Equal(start, proxyV2Sig):
+            remote, err = readProxyV2(r)
+        case bytes.HasPrefix(start, []byte("PROXY ")):
+            remote, err = readProxyV1(r)
+        default:
+            err = fmt.Errorf("missing PROXY header")
+    }
+    if err != nil {
+        return nil, err
+    }
+    if remote == nil {
+        remote = conn.RemoteAddr()
+    }
+    return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// "PROXY TCP4 <src> <dst> <sport> <dport>\r\n" or "PROXY UNKNOWN ...\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+    var line []byte
+    for len(line) < proxyV1MaxLen {
+        b, err := r.ReadByte()
+        if err != nil {
+            return nil, fmt.Errorf("reading PROXY header: %v", err)
+        }
+        line = append(line, b)
+        if b == '\n' {
+            break
+        }
+    }
+    if !bytes.HasSuffix(line, []byte("\r\n")) {
+        return nil, fmt.Errorf("PROXY v1 header too long or not terminated")
+    }
+
+    fields := strings.Fields(string(line))
+    if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+        return nil, nil
+    }
+    if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+        return nil, fmt.Errorf("invalid PROXY v1 header %q", strings.TrimSpace(string(line)))
+    }
+    ip := net.ParseIP(fields[2])
+    port, err := strconv.ParseUint(fields[4], 10, 16)
+    if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+        return nil, fmt.Errorf("invalid PROXY v1 source address %s port %s", fields[2], fields[4])
+    }
+    return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// binary header: signature, version/command, family/protocol, length, then
+// addresses and optional TLVs which are skipped
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+    var hdr [16]byte
+    if _, err := io.ReadFull(r, hdr[:]); err != nil {
+        return nil, fmt.Errorf("reading PROXY header: %v", err)
+    }
+    verCmd, family := hdr[12], hdr[13]
+    body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, fmt.Errorf("reading PROXY header: %v", err)
+    }
+
+    if verCmd >> 4 != 2 {
+        return nil, fmt.Errorf("unsupported PROXY version %d", verCmd >> 4)
+    }
+    switch verCmd & 0xf {
+        case 0:     // LOCAL
+            return nil, nil
+        case 1:     // PROXY
+        default:
+            return nil, fmt.Errorf("unsupported PROXY v2 command %d", verCmd & 0xf)
+    }
+
+    switch family {
+        case 0x11:  // TCP over IPv4
+            if len(body) < 12 {
+                return nil, fmt.Errorf("PROXY v2 header too short")
+            }
+            return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+        case 0x21:  // TCP over IPv6
+            if len(body) < 36 {
+                return nil, fmt.Errorf("PROXY v2 header too short")
+            }
+            return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+        default:
+            // other families are allowed, but don't carry a usable address
+            return nil, nil
+    }
+}
@@ -0,0 +1,143 @@
+/*******************************************************************************
+* systemd.go: socket activation and service notification, without libsystemd
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// first file descriptor passed by socket activation, see sd_listen_fds(3)
+const sdListenFdsStart = 3
+
+// Get listening sockets passed by systemd socket activation, or nil if there
+// are none. The environment variables are cleared so child processes (i.e.
+// wake commands) don't see them.
+func ActivationListeners() ([]net.Listener, error) {
+    defer func() {
+        os.Unsetenv("LISTEN_PID")
+        os.Unsetenv("LISTEN_FDS")
+        os.Unsetenv("LISTEN_FDNAMES")
+    }()
+
+    pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+    if err != nil || pid != os.Getpid() {
+        return nil, nil
+    }
+    nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+    if err != nil || nfds <= 0 {
+        return nil, nil
+    }
+    names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+    var listeners []net.Listener
+    for i := 0; i < nfds; i++ {
+        fd := sdListenFdsStart + i
+        name := "LISTEN_FD_" + strconv.Itoa(fd)
+        if i < len(names) && names[i] != "" {
+            name = names[i]
+        }
+        syscall.CloseOnExec(fd)
+
+        // FileListener dups the fd, so the original can be closed
+        f := os.NewFile(uintptr(fd), name)
+        l, err := net.FileListener(f)
+        f.Close()
+        if err != nil {
+            for _, l := range listeners {
+                l.Close()
+            }
+            return nil, fmt.Errorf("socket %s (fd %d) is not a listening socket: %v", name, fd, err)
+        }
+        log.Info("Using socket-activated listener %s on %s", name, l.Addr())
+        listeners = append(listeners, l)
+    }
+    return listeners, nil
+}
+
+// service manager variables that child processes shouldn't see. Unlike the
+// LISTEN_* variables they can't be unset, since we keep using them.
+var sdPrivateEnv = map[string]bool{
+    "NOTIFY_SOCKET":    true,
+    "WATCHDOG_USEC":    true,
+    "WATCHDOG_PID":     true,
+}
+
+// The environment for child processes (i.e. wake commands), without the
+// notify and watchdog variables, so that they can't send notifications for us
+// or mistake our watchdog settings for their own.
+func childEnv() []string {
+    var env []string
+    for _, kv := range os.Environ() {
+        if !sdPrivateEnv[strings.SplitN(kv, "=", 2)[0]] {
+            env = append(env, kv)
+        }
+    }
+    return env
+}
+
+// Send a notification to the service manager, see sd_notify(3). Does
+// nothing if we weren't started with NOTIFY_SOCKET set.
+func sdNotify(state string) {
+    path := os.Getenv("NOTIFY_SOCKET")
+    if path == "" {
+        return
+    }
+    // abstract socket namespace
+    if strings.HasPrefix(path, "@") {
+        path = "\x00" + path[1:]
+    }
+
+    conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+    if err != nil {
+        log.Debug("Failed to connect to notify socket: %v", err)
+        return
+    }
+    defer conn.Close()
+    if _, err = conn.Write([]byte(state)); err != nil {
+        log.Debug("Failed to send notification: %v", err)
+    }
+}
+
+// Send a STATUS= notification, which shows up in "systemctl status"
+func sdStatus(format string, v ...interface{}) {
+    sdNotify("STATUS=" + fmt.Sprintf(format, v...))
+}
+
+// If the service manager has a watchdog enabled for us, ping it at half the
+// timeout until ctx is cancelled.
+func StartWatchdog(ctx context.Context) {
+    usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+    if err != nil || usec <= 0 {
+        return
+    }
+    if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+        return
+    }
+
+    interval := time.Duration(usec) * time.Microsecond / 2
+    log.Debug("Sending watchdog notifications every %v", interval)
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+                case <-ticker.C:
+                    sdNotify("WATCHDOG=1")
+                case <-ctx.Done():
+                    return
+            }
+        }
+    }()
+}
@@ -0,0 +1,145 @@
+/*******************************************************************************
+* waker.go: transports for delivering magic packets
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "net"
+    "os/exec"
+    "strings"
+    "time"
+)
+
+// A Waker delivers a magic packet for a host. packet is the complete magic
+// packet payload, including any SecureOn password.
+type Waker interface {
+    Wake(h *HostConfig, packet []byte) error
+}
+
+// ways to send magic packets
+const (
+    TRANSPORT_UDP       = "udp"         // UDP broadcast
+    TRANSPORT_UNICAST   = "unicast"     // UDP directly to the host's address
+    TRANSPORT_ETHER     = "ether"       // raw ethernet frame with EtherType 0x0842
+    TRANSPORT_COMMAND   = "command"     // run an external command
+)
+
+// Waker for each transport. Tests can replace entries to record packets
+// rather than sending them.
+var wakers = map[string]Waker{
+    TRANSPORT_UDP:      udpBroadcastWaker{},
+    TRANSPORT_UNICAST:  udpUnicastWaker{},
+    TRANSPORT_ETHER:    etherWaker{},
+    TRANSPORT_COMMAND:  commandWaker{},
+}
+
+// how long an external wake command may run
+const wakeCommandTimeout = 30 * time.Second
+
+func validTransport(t string) bool {
+    _, ok := wakers[t]
+    return ok
+}
+
+// UDP to each of the host's broadcast addresses
+type udpBroadcastWaker struct{}
+
+func (udpBroadcastWaker) Wake(h *HostConfig, packet []byte) error {
+    bcasts, err := ExpandBroadcastAddrs(h.BroadcastAddrs())
+    if err != nil {
+        return err
+    }
+
+    // already validated when loading the config
+    source := net.ParseIP(h.Source)
+    iface := h.GetInterface()
+    for _, b := range bcasts {
+        if err = SendWol(&b, packet, iface, source); err != nil {
+            return err
+        }
+        if iface != "" {
+            log.Info("Sent magic packet for %s to %s via %s", h.MAC, b.Marshal(), iface)
+        } else {
+            log.Info("Sent magic packet for %s to %s", h.MAC, b.Marshal())
+        }
+    }
+    return nil
+}
+
+// UDP directly to the host's address, for hosts reachable through a router
+// that has a static ARP entry for them, or which are asleep but still
+// answering on their IP.
+type udpUnicastWaker struct{}
+
+func (udpUnicastWaker) Wake(h *HostConfig, packet []byte) error {
+    ips, err := net.LookupIP(h.Address)
+    if err != nil || len(ips) == 0 {
+        return fmt.Errorf("Failed to resolve address of host %s: %v", h.Name, err)
+    }
+
+    addr := BroadcastAddr{addr: ips[0].String(), port: h.WakePort}
+    if err = SendWol(&addr, packet, h.GetInterface(), net.ParseIP(h.Source)); err != nil {
+        return err
+    }
+    log.Info("Sent unicast magic packet for %s to %s", h.MAC, addr.Marshal())
+    return nil
+}
+
+// Raw ethernet frame on the host's interface. The frame is sent to the
+// broadcast MAC unless EtherUnicast is set, in which case it goes directly to
+// the host's MAC.
+type etherWaker struct{}
+
+func (etherWaker) Wake(h *HostConfig, packet []byte) error {
+    dest := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+    if h.EtherUnicast {
+        var err error
+        if dest, err = net.ParseMAC(h.MAC); err != nil {
+            return fmt.Errorf("Invalid MAC address: %s", err)
+        }
+    }
+
+    iface := h.GetInterface()
+    if err := sendEtherFrame(iface, dest, packet); err != nil {
+        return fmt.Errorf("Failed to send raw ethernet magic packet: %s", err)
+    }
+    log.Info("Sent raw ethernet magic packet for %s to %s via %s", h.MAC, dest, iface)
+    return nil
+}
+
+// Run an external command, e.g. to wake a host through IPMI or a smart plug.
+// The command line is split on whitespace and run without a shell. Host
+// details are passed in WOL_* environment variables and the magic packet is
+// written to stdin.
+type commandWaker struct{}
+
+func (commandWaker) Wake(h *HostConfig, packet []byte) error {
+    args := strings.Fields(h.GetWakeCommand())
+    ctx, cancel := context.WithTimeout(context.Background(), wakeCommandTimeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+    cmd.Env = append(childEnv(),
+        "WOL_HOST=" + h.Name,
+        "WOL_MAC=" + h.MAC,
+        "WOL_ADDRESS=" + h.Address,
+        "WOL_INTERFACE=" + h.GetInterface(),
+    )
+    cmd.Stdin = bytes.NewReader(packet)
+    out, err := cmd.CombinedOutput()
+    if len(out) > 0 {
+        log.Debug("Wake command output for %s: %s", h.Name, strings.TrimSpace(string(out)))
+    }
+    if err != nil {
+        return fmt.Errorf("Wake command for host %s failed: %s", h.Name, err)
+    }
+    log.Info("Ran wake command for %s (%s)", h.Name, h.MAC)
+    return nil
+}
@@ -0,0 +1,141 @@
+/*******************************************************************************
+* waker_test.go: tests for HandleWolCmd using a fake transport
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "bytes"
+    "errors"
+    "testing"
+
+    "golang.org/x/crypto/ssh"
+)
+
+// a Waker that records packets instead of sending them
+type recordWaker struct {
+    hosts   []*HostConfig
+    packets [][]byte
+    err     error
+}
+
+func (w *recordWaker) Wake(h *HostConfig, packet []byte) error {
+    w.hosts = append(w.hosts, h)
+    w.packets = append(w.packets, packet)
+    return w.err
+}
+
+// Install a test config with hosts pc1 (with a SecureOn password) and pc2,
+// and replace the UDP transport with a recorder. Everything is restored when
+// the test finishes.
+func setupWakeTest(t *testing.T) *recordWaker {
+    c := DefaultConfig()
+    if err := c.ParseGlobal(); err != nil {
+        t.Fatal(err)
+    }
+    for name, line := range map[string]string{
+        "pc1": "de:ad:be:ef:12:34",
+        "pc2": "de:ad:be:ef:12:35",
+    } {
+        h, err := c.ParseHostLine(name, line)
+        if err != nil {
+            t.Fatal(err)
+        }
+        c.Hosts[name] = h
+    }
+    c.Hosts["pc1"].Password = "192.168.1.2"
+    if err := c.Hosts["pc1"].Validate(); err != nil {
+        t.Fatal(err)
+    }
+
+    oldConf, oldWaker := Conf(), wakers[TRANSPORT_UDP]
+    rec := &recordWaker{}
+    setConf(c)
+    wakers[TRANSPORT_UDP] = rec
+    t.Cleanup(func() {
+        setConf(oldConf)
+        wakers[TRANSPORT_UDP] = oldWaker
+    })
+    return rec
+}
+
+// permissions for a user allowed to wake only pc1
+func testPerms() *ssh.Permissions {
+    return &ssh.Permissions{Extensions: UserPermissions(&UserConfig{Name: "test"}, []string{"pc1"})}
+}
+
+func TestHandleWolCmd(t *testing.T) {
+    rec := setupWakeTest(t)
+
+    h, msg, status := HandleWolCmd("pc1", testPerms())
+    if status != EXIT_OK || h == nil || h.Name != "pc1" {
+        t.Fatalf("waking pc1: status %d, message %q", status, msg)
+    }
+    if len(rec.hosts) != 1 || rec.hosts[0].Name != "pc1" {
+        t.Fatalf("transport called for %v, want [pc1]", rec.hosts)
+    }
+
+    // header, 16 copies of the MAC, then the password
+    mac := []byte{0xde, 0xad, 0xbe, 0xef, 0x12, 0x34}
+    want := bytes.Repeat([]byte{0xff}, 6)
+    want = append(want, bytes.Repeat(mac, 16)...)
+    want = append(want, 192, 168, 1, 2)
+    if !bytes.Equal(rec.packets[0], want) {
+        t.Errorf("packet is\n%x\nwant\n%x", rec.packets[0], want)
+    }
+}
+
+func TestHandleWolCmdDenied(t *testing.T) {
+    rec := setupWakeTest(t)
+
+    h, msg, status := HandleWolCmd("pc2", testPerms())
+    if status != EXIT_DENIED || h != nil {
+        t.Errorf("waking pc2 without permission: status %d, message %q, want EXIT_DENIED", status, msg)
+    }
+    if len(rec.packets) != 0 {
+        t.Errorf("transport called %d times for a denied host", len(rec.packets))
+    }
+}
+
+func TestHandleWolCmdSendFailed(t *testing.T) {
+    rec := setupWakeTest(t)
+    rec.err = errors.New("network is down")
+
+    h, msg, status := HandleWolCmd("pc1", testPerms())
+    if status != EXIT_SEND_FAILED || h != nil {
+        t.Errorf("transport error: status %d, want EXIT_SEND_FAILED", status)
+    }
+    if msg != rec.err.Error() {
+        t.Errorf("transport error message is %q, want %q", msg, rec.err.Error())
+    }
+}
+
+// A configured host's MAC is treated as its alias, even for users who may
+// wake raw MACs
+func TestHandleWolCmdConfiguredMAC(t *testing.T) {
+    rec := setupWakeTest(t)
+    perms := &ssh.Permissions{Extensions: UserPermissions(&UserConfig{Name: "test", AllowMAC: true}, []string{"pc1"})}
+
+    h, msg, status := HandleWolCmd("DE-AD-BE-EF-12-34", perms)
+    if status != EXIT_OK || h == nil || h.Name != "pc1" {
+        t.Fatalf("waking pc1 by MAC: status %d, message %q", status, msg)
+    }
+    if p := rec.packets[0]; !bytes.Equal(p[len(p)-4:], []byte{192, 168, 1, 2}) || len(p) != 106 {
+        t.Errorf("packet for pc1 by MAC doesn't have its SecureOn password: %x", p)
+    }
+
+    if _, msg, status = HandleWolCmd("de:ad:be:ef:12:35", perms); status != EXIT_DENIED {
+        t.Errorf("waking pc2 by MAC: status %d, message %q, want EXIT_DENIED", status, msg)
+    }
+
+    h, msg, status = HandleWolCmd("02:00:00:00:00:01", perms)
+    if status != EXIT_OK || h == nil || h.password != nil {
+        t.Errorf("waking an unknown MAC: status %d, message %q", status, msg)
+    }
+    if len(rec.packets) != 2 {
+        t.Errorf("transport called %d times, want 2", len(rec.packets))
+    }
+}
@@ -8,17 +8,25 @@
 package main
 
 import (
+    "encoding/hex"
     "fmt"
     "net"
+    "sort"
     "strconv"
     "strings"
+    "syscall"
 
     sawol "github.com/sabhiram/go-wol/wol"
+    "golang.org/x/crypto/ssh"
 )
 
+// A broadcast address and port. If auto or iface is set, then addr is
+// empty and the real addresses are computed by ExpandBroadcastAddrs.
 type BroadcastAddr struct {
-    addr string
-    port int
+    addr    string
+    port    int
+    iface   string  // use broadcast addresses of this network interface
+    auto    bool    // use broadcast addresses of all network interfaces
 }
 
 const defaultPort int = 40000
@@ -27,31 +35,175 @@ var aliasMap = map[string]string{
     "redacted": "00:00:00:00:00:00",
 }
 
+// Parse a broadcast address, one of
+//   <IPv4 address>[:port]
+//   [<IPv6 multicast address>%<interface>][:port]
+//   iface:<interface name>[:port]
+//   auto[:port]
 func MakeBroadcastAddr(s string) (*BroadcastAddr) {
+    if strings.HasPrefix(s, "[") {
+        return makeIPv6BroadcastAddr(s)
+    }
+
     sp := strings.Split(s, ":")
-    addr := sp[0]
-    if !validIPv4Bcast(addr) {
-        return nil
+    b := BroadcastAddr{port: defaultPort}
+    switch sp[0] {
+        case "auto":
+            b.auto = true
+            sp = sp[1:]
+        case "iface":
+            if len(sp) < 2 || sp[1] == "" {
+                return nil
+            }
+            b.iface = sp[1]
+            sp = sp[2:]
+        default:
+            if !validIPv4Bcast(sp[0]) {
+                return nil
+            }
+            b.addr = sp[0]
+            sp = sp[1:]
     }
 
-    port := defaultPort
     switch len(sp) {
+        case 0:
+            // no-op, use default port
         case 1:
-            // no-op, handled above
-        case 2:
             var err error
-            port, err = strconv.Atoi(sp[1])
+            b.port, err = strconv.Atoi(sp[0])
             if err != nil {
                 return nil
             }
         default:
             return nil
     }
-    return &BroadcastAddr{addr, port}
+    return &b
+}
+
+// Parse an IPv6 multicast address in brackets, with an optional port.
+// Multicast needs to know which interface to send on, so the zone is required.
+func makeIPv6BroadcastAddr(s string) (*BroadcastAddr) {
+    b := BroadcastAddr{port: defaultPort}
+    if strings.HasSuffix(s, "]") {
+        b.addr = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+    } else {
+        host, port, err := net.SplitHostPort(s)
+        if err != nil {
+            return nil
+        }
+        if b.port, err = strconv.Atoi(port); err != nil {
+            return nil
+        }
+        b.addr = host
+    }
+
+    if !validIPv6Mcast(b.addr) {
+        return nil
+    }
+    return &b
 }
 
 func (b *BroadcastAddr) Marshal() string {
-    return fmt.Sprintf("%s:%d", b.addr, b.port)
+    if b.auto {
+        return fmt.Sprintf("auto:%d", b.port)
+    } else if b.iface != "" {
+        return fmt.Sprintf("iface:%s:%d", b.iface, b.port)
+    }
+    return net.JoinHostPort(b.addr, strconv.Itoa(b.port))
+}
+
+// UDP network to use for this address, "udp4" or "udp6"
+func (b *BroadcastAddr) Network() string {
+    if strings.Contains(b.addr, ":") {
+        return "udp6"
+    }
+    return "udp4"
+}
+
+// Resolve auto and iface broadcast addresses using the current state of the
+// network interfaces. This is done every time packets are sent so that
+// changing interface addresses (e.g. from DHCP) are picked up.
+func ExpandBroadcastAddrs(list []BroadcastAddr) ([]BroadcastAddr, error) {
+    var result []BroadcastAddr
+    seen := map[string]bool{}
+    add := func(addr string, port int) {
+        b := BroadcastAddr{addr: addr, port: port}
+        if !seen[b.Marshal()] {
+            seen[b.Marshal()] = true
+            result = append(result, b)
+        }
+    }
+
+    for _, b := range list {
+        var ifaces []net.Interface
+        if b.auto {
+            all, err := net.Interfaces()
+            if err != nil {
+                return nil, fmt.Errorf("Failed to list network interfaces: %s", err)
+            }
+            for _, iface := range all {
+                if iface.Flags & net.FlagUp != 0 &&
+                   iface.Flags & net.FlagBroadcast != 0 &&
+                   iface.Flags & net.FlagLoopback == 0 {
+                    ifaces = append(ifaces, iface)
+                }
+            }
+        } else if b.iface != "" {
+            iface, err := net.InterfaceByName(b.iface)
+            if err != nil {
+                return nil, fmt.Errorf("Failed to find broadcast interface %s: %s", b.iface, err)
+            }
+            ifaces = append(ifaces, *iface)
+        } else {
+            add(b.addr, b.port)
+            continue
+        }
+
+        for _, iface := range ifaces {
+            addrs, err := interfaceBroadcasts(&iface)
+            if err != nil {
+                return nil, fmt.Errorf("Failed to get addresses of %s: %s", iface.Name, err)
+            }
+            log.Debug("Broadcast addresses for %s: %v", iface.Name, addrs)
+            for _, addr := range addrs {
+                add(addr, b.port)
+            }
+        }
+    }
+
+    if len(result) == 0 {
+        return nil, fmt.Errorf("No broadcast addresses available")
+    }
+    return result, nil
+}
+
+// Compute the directed broadcast address of each IPv4 subnet on a network
+// interface.
+func interfaceBroadcasts(iface *net.Interface) ([]string, error) {
+    addrs, err := iface.Addrs()
+    if err != nil {
+        return nil, err
+    }
+
+    var bcasts []string
+    for _, a := range addrs {
+        ipnet, ok := a.(*net.IPNet)
+        if !ok {
+            continue
+        }
+        ip := ipnet.IP.To4()
+        ones, bits := ipnet.Mask.Size()
+        // /31 and /32 subnets have no broadcast address
+        if ip == nil || bits != 32 || bits - ones < 2 {
+            continue
+        }
+        bcast := make(net.IP, 4)
+        for i := range ip {
+            bcast[i] = ip[i] | ^ipnet.Mask[i]
+        }
+        bcasts = append(bcasts, bcast.String())
+    }
+    return bcasts, nil
 }
 
 func validIPv4Bcast(addr string) bool {
@@ -63,58 +215,220 @@ func validIPv4Bcast(addr string) bool {
            !ip.IsUnspecified()
 }
 
-func ResolveHost(a string) (string, error) {
-    if mac, ok := conf.Hosts[a]; ok {
-        return mac, nil
+// addr must be an IPv6 multicast address with a zone, e.g. ff02::1%eth0
+func validIPv6Mcast(addr string) bool {
+    sp := strings.SplitN(addr, "%", 2)
+    if len(sp) != 2 || sp[1] == "" {
+        return false
+    }
+    ip := net.ParseIP(sp[0])
+    return ip != nil &&
+           ip.To4() == nil &&
+           ip.IsMulticast()
+}
+
+func ResolveHost(a string) (*HostConfig, error) {
+    if h, ok := Conf().Hosts[a]; ok {
+        return h, nil
     } else {
-        return "", fmt.Errorf("Couldn't find host '%s'", a)
+        return nil, fmt.Errorf("Couldn't find host '%s'", a)
     }
 }
 
-func SendWol(bcast *BroadcastAddr, mac string) (error) {
+// Parse a 6-byte MAC address in any of the common formats: colon or dash
+// separated (aa:bb:cc:dd:ee:ff), dotted Cisco (aabb.ccdd.eeff), or bare hex
+// (aabbccddeeff).
+func ParseMAC(s string) (net.HardwareAddr, error) {
+    var hw net.HardwareAddr
+    var err error
+    if len(s) == 12 {
+        hw, err = hex.DecodeString(s)
+    } else {
+        hw, err = net.ParseMAC(s)
+    }
+    if err != nil || len(hw) != 6 {
+        return nil, fmt.Errorf("invalid MAC address '%s'", s)
+    }
+    return hw, nil
+}
+
+// Parse a SecureOn password, which is either 4 or 6 bytes. Accepted formats
+// are dotted decimal for 4 bytes (like an IPv4 address), or hex bytes
+// separated by ':' or '-' (like a MAC address), or plain hex.
+func ParseSecureOnPassword(s string) ([]byte, error) {
+    var pw []byte
+    if strings.Contains(s, ".") {
+        if ip := net.ParseIP(s); ip != nil && ip.To4() != nil && !strings.Contains(s, ":") {
+            pw = []byte(ip.To4())
+        }
+    } else {
+        var hexStr string
+        if strings.ContainsAny(s, ":-") {
+            sep := ":"
+            if !strings.Contains(s, sep) {
+                sep = "-"
+            }
+            // every byte must be two hex digits with the same separator
+            for _, b := range strings.Split(s, sep) {
+                if len(b) != 2 || strings.ContainsAny(b, ":-") {
+                    return nil, fmt.Errorf("invalid SecureOn password '%s'", s)
+                }
+                hexStr += b
+            }
+        } else {
+            hexStr = s
+        }
+        pw, _ = hex.DecodeString(hexStr)
+    }
+
+    if len(pw) != 4 && len(pw) != 6 {
+        return nil, fmt.Errorf("invalid SecureOn password '%s', must be 4 or 6 bytes", s)
+    }
+    return pw, nil
+}
+
+// Build a magic packet for mac, with an optional SecureOn password appended.
+// The result is 102 bytes, or 106/108 with a password.
+func MakeMagicPacket(mac string, password []byte) ([]byte, error) {
     packet, err := sawol.New(mac)
     if err != nil {
-        return fmt.Errorf("Failed to create magic packet: %s", err)
+        return nil, fmt.Errorf("Failed to create magic packet: %s", err)
     }
 
     packetBytes, err := packet.Marshal()
     if err != nil {
-        return fmt.Errorf("Failed to marshal magic packet: %s", err)
+        return nil, fmt.Errorf("Failed to marshal magic packet: %s", err)
     }
+    return append(packetBytes, password...), nil
+}
 
-    baddr, err := net.ResolveUDPAddr("udp4", bcast.Marshal())
-    if err != nil {
-        return fmt.Errorf("Failed to resolve UDP broadcast address: %s", err)
+// Send a magic packet to a UDP address, usually broadcast or IPv6 multicast.
+// If iface is non-empty, the socket is bound to that network interface. If
+// source is non-nil, it's used as the local address.
+func SendWol(bcast *BroadcastAddr, packet []byte, iface string, source net.IP) (error) {
+    dialer := net.Dialer{}
+    if source != nil {
+        dialer.LocalAddr = &net.UDPAddr{IP: source}
+    }
+    if iface != "" {
+        dialer.Control = func(network, address string, c syscall.RawConn) error {
+            var bindErr error
+            err := c.Control(func(fd uintptr) {
+                bindErr = bindToDevice(fd, iface)
+            })
+            if err != nil {
+                return err
+            }
+            return bindErr
+        }
     }
 
-    conn, err := net.DialUDP("udp4", nil, baddr)
+    conn, err := dialer.Dial(bcast.Network(), bcast.Marshal())
     if err != nil {
         return fmt.Errorf("Failed to dial UDP connection: %s", err)
     }
     defer conn.Close()
 
-    n, err := conn.Write(packetBytes)
+    n, err := conn.Write(packet)
     if err != nil {
         return fmt.Errorf("Failed to send magic packet")
-    } else if n != 102 {
-        return fmt.Errorf("expected to send 102 bytes but sent only %d", n)
+    } else if n != len(packet) {
+        return fmt.Errorf("expected to send %d bytes but sent only %d", len(packet), n)
     }
-
-    log.Info("Sent magic packet for %s to %s", mac, bcast.Marshal())
     return nil
 }
 
-func HandleWolCmd(cmd string) (string, byte) {
-    mac, err := ResolveHost(cmd)
+// Look up a host that a user wants to wake and check that they're allowed
+// to. Users with permission can also give a raw MAC address, which is woken
+// using the global settings. On failure, returns an error message and exit
+// status. Permission is checked before the host is looked up, so users can't
+// find out other users' host names.
+func ResolveWakeHost(name string, perms *ssh.Permissions) (*HostConfig, string, byte) {
+    alias := name
+    if _, isHost := Conf().Hosts[name]; !isHost {
+        if hw, err := ParseMAC(name); err == nil {
+            // the MAC of a configured host is the same as its alias, so it
+            // gets that host's ACL and settings (e.g. SecureOn password)
+            alias = macAlias(hw.String(), perms)
+            if alias == "" {
+                return wakeRawMAC(hw, perms)
+            }
+        }
+    }
+
+    // report denials with the name the user gave, the same way as for
+    // unknown MACs, so users can't tell which MACs are configured
+    if !PermsAllowHost(perms, alias) {
+        what := "host"
+        if alias != name {
+            what = "MAC address"
+        }
+        log.Warning("Denied request to wake %s '%s'", what, name)
+        return nil, fmt.Sprintf("Permission denied for %s '%s'", what, name), EXIT_DENIED
+    }
+    h, err := ResolveHost(alias)
     if err != nil {
-        return err.Error(), 1
+        return nil, err.Error(), EXIT_UNKNOWN_HOST
     }
+    return h, "", EXIT_OK
+}
 
-    for _, b := range conf.bcastAddrs {
-        if err = SendWol(&b, mac); err != nil {
-            return err.Error(), 2
+// The alias of a configured host with this MAC, preferring one the user may
+// wake if several hosts share it. Returns "" if no host has this MAC.
+func macAlias(mac string, perms *ssh.Permissions) string {
+    var names []string
+    for name, h := range Conf().Hosts {
+        if h.MAC == mac {
+            names = append(names, name)
         }
     }
+    sort.Strings(names)
+    for _, name := range names {
+        if PermsAllowHost(perms, name) {
+            return name
+        }
+    }
+    if len(names) > 0 {
+        return names[0]
+    }
+    return ""
+}
+
+// a MAC address that isn't any configured host's, woken using the global
+// settings if the user has permission
+func wakeRawMAC(hw net.HardwareAddr, perms *ssh.Permissions) (*HostConfig, string, byte) {
+    if !PermsAllowMAC(perms) {
+        log.Warning("Denied request to wake MAC address '%s'", hw)
+        return nil, fmt.Sprintf("Permission denied for MAC address '%s'", hw), EXIT_DENIED
+    }
+    h := Conf().NewHostConfig(hw.String())
+    h.MAC = hw.String()
+    if err := h.Validate(); err != nil {
+        return nil, err.Error(), EXIT_SEND_FAILED
+    }
+    return h, "", EXIT_OK
+}
+
+func HandleWolCmd(cmd string, perms *ssh.Permissions) (*HostConfig, string, byte) {
+    h, msg, status := ResolveWakeHost(cmd, perms)
+    if h == nil {
+        return nil, msg, status
+    }
+    if msg, status = WakeHost(h); status != EXIT_OK {
+        return nil, msg, status
+    }
+    return h, msg, status
+}
 
-    return fmt.Sprintf("Woke up host %s (%s)", cmd, mac), 0
+// Send a magic packet to a host found by ResolveWakeHost, returning a
+// message and exit status
+func WakeHost(h *HostConfig) (string, byte) {
+    packet, err := MakeMagicPacket(h.MAC, h.password)
+    if err != nil {
+        return err.Error(), EXIT_SEND_FAILED
+    }
+    if err = wakers[h.GetTransport()].Wake(h, packet); err != nil {
+        return err.Error(), EXIT_SEND_FAILED
+    }
+    return fmt.Sprintf("Woke up host %s (%s)", h.Name, h.MAC), EXIT_OK
 }
@@ -0,0 +1,107 @@
+/*******************************************************************************
+* wol_test.go: tests for SecureOn passwords and magic packets
+*
+* Copyright 2018 Allen Wild <allenwild93@gmail.com>
+* SPDX-License-Identifier: MIT
+*******************************************************************************/
+
+package main
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestParseSecureOnPassword(t *testing.T) {
+    tests := []struct {
+        in      string
+        want    []byte  // nil if an error is expected
+    }{
+        {"192.168.1.2", []byte{192, 168, 1, 2}},
+        {"0.0.0.0", []byte{0, 0, 0, 0}},
+        {"01020304", []byte{1, 2, 3, 4}},
+        {"a1b2c3d4e5f6", []byte{0xa1, 0xb2, 0xc3, 0xd4, 0xe5, 0xf6}},
+        {"A1:B2:C3:D4", []byte{0xa1, 0xb2, 0xc3, 0xd4}},
+        {"a1:b2:c3:d4:e5:f6", []byte{0xa1, 0xb2, 0xc3, 0xd4, 0xe5, 0xf6}},
+        {"a1-b2-c3-d4-e5-f6", []byte{0xa1, 0xb2, 0xc3, 0xd4, 0xe5, 0xf6}},
+
+        // bad lengths
+        {"", nil},
+        {"010203", nil},
+        {"0102030405", nil},
+        {"01020304050607", nil},
+        {"01:02:03", nil},
+        {"01:02:03:04:05", nil},
+        {"01:02:03:04:05:06:07", nil},
+        {"1.2.3", nil},
+        {"1.2.3.4.5.6", nil},
+        {"256.1.1.1", nil},
+
+        // bad separators and digits
+        {"01:02-03:04", nil},
+        {"01::02:03:04", nil},
+        {":01:02:03:04", nil},
+        {"01:02:03:04:", nil},
+        {"1:2:3:4", nil},
+        {"001:02:03:04", nil},
+        {"01_02_03_04", nil},
+        {"01 02 03 04", nil},
+        {"0102.0304", nil},
+        {"::ffff:1.2.3.4", nil},
+        {"zz:02:03:04", nil},
+        {"0102030g", nil},
+    }
+
+    for _, tt := range tests {
+        got, err := ParseSecureOnPassword(tt.in)
+        if tt.want == nil {
+            if err == nil {
+                t.Errorf("ParseSecureOnPassword(%q) = %x, want error", tt.in, got)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("ParseSecureOnPassword(%q) error: %v", tt.in, err)
+        } else if !bytes.Equal(got, tt.want) {
+            t.Errorf("ParseSecureOnPassword(%q) = %x, want %x", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestMakeMagicPacket(t *testing.T) {
+    mac := []byte{0xde, 0xad, 0xbe, 0xef, 0x12, 0x34}
+    tests := []struct {
+        password    []byte
+        length      int
+    }{
+        {nil, 102},
+        {[]byte{192, 168, 1, 2}, 106},
+        {[]byte{1, 2, 3, 4, 5, 6}, 108},
+    }
+
+    for _, tt := range tests {
+        packet, err := MakeMagicPacket("de:ad:be:ef:12:34", tt.password)
+        if err != nil {
+            t.Fatalf("MakeMagicPacket with %d byte password: %v", len(tt.password), err)
+        }
+        if len(packet) != tt.length {
+            t.Errorf("packet with %d byte password is %d bytes, want %d", len(tt.password), len(packet), tt.length)
+            continue
+        }
+        if !bytes.Equal(packet[:6], bytes.Repeat([]byte{0xff}, 6)) {
+            t.Errorf("packet header is %x, want ffffffffffff", packet[:6])
+        }
+        for i := 0; i < 16; i++ {
+            if got := packet[6+6*i : 12+6*i]; !bytes.Equal(got, mac) {
+                t.Errorf("MAC copy %d is %x, want %x", i, got, mac)
+            }
+        }
+        if pw := packet[102:]; !bytes.Equal(pw, tt.password) {
+            t.Errorf("packet ends with %x, want password %x", pw, tt.password)
+        }
+    }
+
+    if _, err := MakeMagicPacket("not a mac", nil); err == nil {
+        t.Errorf("MakeMagicPacket with invalid MAC succeeded")
+    }
+}